@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/itsubaki/autograd/function"
 	"github.com/itsubaki/autograd/layer"
 	"github.com/itsubaki/autograd/variable"
@@ -11,6 +14,9 @@ var (
 	Zeros               = variable.Zero
 	Ones                = pkg.Ones
 	ReLU                = function.ReLU
+	GELU                = pkg.GELU
+	GELUTanh            = pkg.GELUTanh
+	SiLU                = pkg.SiLU
 	Dropout             = function.DropoutSimple
 	MatMul              = pkg.MatMul
 	Add                 = variable.Add
@@ -20,65 +26,200 @@ var (
 	Softmax             = function.Softmax
 	SoftmaxCrossEntropy = function.SoftmaxCrossEntropy
 	RandEmbeds          = pkg.Normal
+	Sinusoidal          = pkg.Sinusoidal
 	Rows                = pkg.Rows
 	Val                 = pkg.Val
 	Flat                = pkg.Flat
 )
 
 type Block struct {
-	embedSize int
-	headCount int
-	saHead    *MultiHeadAttention
-	mlp       *Linear // multi-layer perceptron
-	mlpProj   *Linear // projects the output of the MLP back to the original embedding size
-	norm1     *LayerNorm
-	norm2     *LayerNorm
+	embedSize   int
+	headCount   int
+	saHead      *MultiHeadAttention
+	mlp         *Linear // multi-layer perceptron
+	mlpGate     *Linear // gates the activated MLP output elementwise, nil unless SwiGLU
+	mlpProj     *Linear // projects the output of the MLP back to the original embedding size
+	norm1       Norm
+	norm2       Norm
+	dropout     float64
+	attention   []AttentionOption
+	activation  func(x ...*variable.Variable) *variable.Variable
+	hiddenRatio float64 // size of the MLP hidden layer relative to the embedding size
+	swiGLU      bool
+	residual    string // where the residual stream is normalized: PreNorm, PostNorm or LegacyNorm
+	moe         *MoE   // replaces the MLP if there are experts
+	experts     int    // number of expert MLPs, see WithMoE
+	topK        int
+	capacity    float64
+}
+
+const (
+	PreNorm    = "pre_norm"  // x + Attn(Norm(x)), then x + MLP(Norm(x)), as in GPT-2
+	PostNorm   = "post_norm" // Norm(x + Attn(x)), then Norm(x + MLP(x)), as in the original Transformer
+	LegacyNorm = "legacy"    // x = Norm(x), then x + Attn(x), the residual stream is normalized and the scores doubled, for older checkpoints
+)
+
+type BlockOption func(*Block)
+
+// WithDropout disables the given fraction of neurons during training to prevent overfitting.
+func WithDropout(ratio float64) BlockOption {
+	return func(b *Block) {
+		b.dropout = ratio
+	}
+}
+
+// WithAttention configures the self-attention of the block.
+func WithAttention(opts ...AttentionOption) BlockOption {
+	return func(b *Block) {
+		b.attention = append(b.attention, opts...)
+	}
+}
+
+// WithResidual sets where the residual stream is normalized, PreNorm by default.
+func WithResidual(residual string) BlockOption {
+	return func(b *Block) {
+		b.residual = residual
+	}
+}
+
+// WithRMSNorm replaces both LayerNorms of the block with RMSNorms.
+func WithRMSNorm() BlockOption {
+	return func(b *Block) {
+		b.norm1 = NewRMSNorm(b.embedSize)
+		b.norm2 = NewRMSNorm(b.embedSize)
+	}
+}
+
+// WithActivation replaces ReLU between the MLP layers, e.g. with GELU.
+func WithActivation(activation func(x ...*variable.Variable) *variable.Variable) BlockOption {
+	return func(b *Block) {
+		b.activation = activation
+	}
+}
+
+// WithHiddenRatio sets the size of the MLP hidden layer to ratio*embedSize, 4 by default.
+func WithHiddenRatio(ratio float64) BlockOption {
+	return func(b *Block) {
+		b.hiddenRatio = ratio
+	}
+}
+
+// WithSwiGLU replaces the MLP with SwiGLU: mlpProj(SiLU(mlp(x)) * mlpGate(x)).
+// It has three projections instead of two, so the hidden ratio is usually reduced to 8/3 to keep the size.
+func WithSwiGLU() BlockOption {
+	return func(b *Block) {
+		b.swiGLU = true
+		b.activation = SiLU
+	}
+}
+
+// WithMoE replaces the MLP with a mixture of experts MLPs, every token is processed by topK of them,
+// see MoE for the capacity. Experts are shaped as the MLP, with its activation and hidden ratio.
+func WithMoE(experts, topK int, capacity float64) BlockOption {
+	return func(b *Block) {
+		b.experts = experts
+		b.topK = topK
+		b.capacity = capacity
+	}
 }
 
-func NewBlock(embedSize, numHeads int) *Block {
-	return &Block{
-		embedSize: embedSize,
-		headCount: numHeads,
-		saHead:    NewMultiHeadAttention(embedSize, numHeads),
-		mlp:       NewLinear(embedSize, embedSize*4),
-		mlpProj:   NewLinear(embedSize*4, embedSize),
-		norm1:     NewLayerNorm(embedSize),
-		norm2:     NewLayerNorm(embedSize),
+func NewBlock(embedSize, numHeads int, opts ...BlockOption) *Block {
+	b := &Block{
+		embedSize:   embedSize,
+		headCount:   numHeads,
+		norm1:       NewLayerNorm(embedSize),
+		norm2:       NewLayerNorm(embedSize),
+		activation:  ReLU,
+		hiddenRatio: 4,
+		residual:    PreNorm,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.residual != PreNorm && b.residual != PostNorm && b.residual != LegacyNorm {
+		panic(fmt.Sprintf("unknown residual '%s'", b.residual))
+	}
+
+	hiddenSize := int(math.Round(b.hiddenRatio * float64(embedSize)))
+	if b.experts > 0 {
+		b.moe = NewMoE(embedSize, hiddenSize, b.experts, b.topK, b.capacity, b.activation, b.swiGLU, b.dropout)
+	} else {
+		b.mlp = NewLinear(embedSize, hiddenSize)
+		b.mlpProj = NewLinear(hiddenSize, embedSize)
+		if b.swiGLU {
+			b.mlpGate = NewLinear(embedSize, hiddenSize)
+		}
+	}
+	attention := append([]AttentionOption{AttentionDropout(b.dropout)}, b.attention...)
+	if b.residual == LegacyNorm {
+		attention = append(attention, WithDoubledScores()) // older checkpoints were trained with them
 	}
+	b.saHead = NewMultiHeadAttention(embedSize, numHeads, attention...)
+
+	return b
 }
 
 func (b *Block) Forward(input *variable.Variable) *variable.Variable {
-	// Self-attention with residual connections. Input is our highway, we allow the gradient to flow back unimpeded.
-	input = b.norm1.Forward(input)   // Normalize input (mean=0, var=1), i.e. normalize every token's embed
-	saOut := b.saHead.Forward(input) // Encode relationships between positions, (blockSize, embedSize)
-	input = Add(input, saOut)        // Add residual attention output back to main path
-
-	// Feed-forward network with residual connection
-	input = b.norm2.Forward(input)               // Normalize input
-	mlpExpanded := b.mlp.Forward(input)          // Expand to higher dimension
-	mlpActivated := ReLU(mlpExpanded)            // Apply activation function
-	mlpOutput := b.mlpProj.Forward(mlpActivated) // Project back to original dimension
-	mlpOutput = Dropout(dropout)(mlpOutput)      // Dropping out some neurons to prevent overfitting
-	input = Add(input, mlpOutput)                // Add feed-forward residual output to main path
+	return b.ForwardCached(input, nil)
+}
+
+// ForwardCached is Forward using a KVCache per key and value head, see MultiHeadAttention.ForwardCached.
+func (b *Block) ForwardCached(input *variable.Variable, cache []*KVCache) *variable.Variable {
+	switch b.residual {
+	case PostNorm:
+		// Normalize the sums of the input and the outputs, as in the original Transformer.
+		input = b.norm1.Forward(Add(input, b.saHead.ForwardCached(input, cache)))
+		input = b.norm2.Forward(Add(input, b.feedForward(input)))
+	case LegacyNorm:
+		// Residuals carry the normalized input, as the models trained before PreNorm.
+		input = b.norm1.Forward(input)
+		input = Add(input, b.saHead.ForwardCached(input, cache))
+		input = b.norm2.Forward(input)
+		input = Add(input, b.feedForward(input))
+	default:
+		// Self-attention with residual connections. Input is our highway, we allow the gradient to flow back unimpeded.
+		normalized := b.norm1.Forward(input)               // Normalize input (mean=0, var=1), i.e. normalize every token's embed
+		saOut := b.saHead.ForwardCached(normalized, cache) // Encode relationships between positions, (blockSize, embedSize)
+		input = Add(input, saOut)                          // Add residual attention output back to main path
+
+		// Feed-forward network with residual connection
+		mlpOutput := b.feedForward(b.norm2.Forward(input)) // Normalize input, then process every token's embed
+		input = Add(input, mlpOutput)                      // Add feed-forward residual output to main path
+	}
 
 	return input
 }
 
+func (b *Block) feedForward(input *variable.Variable) *variable.Variable {
+	if b.moe != nil {
+		return b.moe.Forward(input)
+	}
+
+	mlpExpanded := b.mlp.Forward(input)       // Expand to higher dimension
+	mlpActivated := b.activation(mlpExpanded) // Apply activation function
+	if b.mlpGate != nil {                     // SwiGLU
+		mlpActivated = Mul(mlpActivated, b.mlpGate.Forward(input))
+	}
+	mlpOutput := b.mlpProj.Forward(mlpActivated) // Project back to original dimension
+	mlpOutput = Dropout(b.dropout)(mlpOutput)    // Dropping out some neurons to prevent overfitting
+
+	return mlpOutput
+}
+
 func (b *Block) Params() []layer.Parameter {
 	var params []layer.Parameter
-<<<<<<< HEAD
 	params = append(params, b.saHead.Params()...)
-	params = append(params, b.ffwd.Weight, b.ffwd.Bias)
-	params = append(params, b.ffwdProj.Weight, b.ffwdProj.Bias)
-=======
-	for _, param := range b.saHead.Params() {
-		params = append(params, param)
-	}
-	params = append(params, b.mlp.Weight, b.mlp.Bias)
-	params = append(params, b.mlpProj.Weight, b.mlpProj.Bias)
->>>>>>> 53c091154abaa97144a7548386713731e84ee094
-	params = append(params, b.norm1.Scale, b.norm1.Shift)
-	params = append(params, b.norm2.Scale, b.norm2.Shift)
+	if b.moe != nil {
+		params = append(params, b.moe.Params()...)
+	} else {
+		params = append(params, b.mlp.Weight, b.mlp.Bias)
+		params = append(params, b.mlpProj.Weight, b.mlpProj.Bias)
+	}
+	params = append(params, b.norm1.Params()...)
+	params = append(params, b.norm2.Params()...)
+	if b.mlpGate != nil {
+		params = append(params, b.mlpGate.Weight, b.mlpGate.Bias)
+	}
 
 	return params
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ModelConfig holds the hyperparameters defining the shape of the model.
+type ModelConfig struct {
+	BlockSize   int     `json:"block_size"` // number of tokens the model sees at once
+	EmbedSize   int     `json:"embed_size"`
+	Heads       int     `json:"heads"`
+	KVHeads     int     `json:"kv_heads"` // number of key and value heads shared by the query heads, defaults to Heads
+	Layers      int     `json:"layers"`
+	Dropout     float64 `json:"dropout"`      // disable some % of our neurons to prevent overfitting, model is likely to generalize
+	Positions   string  `json:"positions"`    // how the model knows the order of tokens: learned (default), sinusoidal, rope or alibi
+	Mask        string  `json:"mask"`         // tokens every token attends to: causal (default), sliding:W, dilated:W:D or prefix:P
+	Activation  string  `json:"activation"`   // of the MLP: relu (default), gelu, gelu_tanh, silu or swiglu
+	HiddenRatio float64 `json:"hidden_ratio"` // size of the MLP hidden layer relative to EmbedSize, defaults to 4
+	Norm        string  `json:"norm"`         // normalization of the embeds: layernorm (default) or rmsnorm
+	Residual    string  `json:"residual"`     // pre_norm (default), post_norm or legacy for the checkpoints trained before pre_norm
+	// Use the token embeds as the output projection instead of a separate lmHead, which is the biggest layer for large vocabularies.
+	TieEmbeddings bool `json:"tie_embeddings"`
+	// Number of tokens the model sees during generation and eval, defaults to BlockSize.
+	// Can be bigger than BlockSize unless positions are learned, which are limited to the trained ones.
+	MaxContext int `json:"max_context"`
+	// Compute the attention in tiles without storing the (T, T) attention matrices, memory grows linearly with BlockSize.
+	FlashAttention bool `json:"flash_attention"`
+	// Number of expert MLPs replacing the MLP of every block, 0 keeps the single MLP.
+	Experts int `json:"experts"`
+	// Number of experts processing every token, defaults to 2, or 1 with a single expert.
+	ExpertsPerToken int `json:"experts_per_token"`
+	// Limits the tokens of an expert during training to capacity_factor times an even share, 0 is no limit.
+	CapacityFactor float64 `json:"capacity_factor"`
+}
+
+const (
+	LearnedPositions    = "learned"    // table of BlockSize embeds added to the token embeds
+	SinusoidalPositions = "sinusoidal" // fixed waves added to the token embeds, see pkg.Sinusoidal
+	RoPEPositions       = "rope"       // queries and keys rotated by their positions, see pkg.RoPE
+	ALiBiPositions      = "alibi"      // attention scores penalized by the distance between tokens, see WithALiBi
+)
+
+// Config holds all the hyperparameters, fields of ModelConfig are inlined in JSON.
+type Config struct {
+	ModelConfig
+	LearningRate     float64 `json:"learning_rate"`
+	Steps            int     `json:"steps"`             // number of training steps, increase for better results
+	EvalSteps        int     `json:"eval_steps"`        // evaluate loss once per every EvalSteps
+	EvalIters        int     `json:"eval_iters"`        // number of validation samples to average the loss over
+	PretrainedTokens int     `json:"pretrained_tokens"` // number of pretrained tokens (merges) to add on top of auto-detected characters
+	MaxTokens        int     `json:"max_tokens"`        // tokens limit for generation
+	EMADecay         float64 `json:"ema_decay"`         // decay of the moving average of weights used for generation, 0 disables averaging
+	ValFraction      float64 `json:"val_fraction"`      // fraction of the dataset held out for validation
+	Patience         int     `json:"patience"`          // stop training after this many evaluations without validation loss improvement
+	AutosaveSteps    int     `json:"autosave_steps"`    // save a checkpoint once per every AutosaveSteps, 0 disables autosaving
+	KeepCheckpoints  int     `json:"keep_checkpoints"`  // number of the most recent checkpoints to keep on disk
+	Replicas         int     `json:"replicas"`          // number of model replicas trained in parallel on different samples
+	// Fine-tuning with LoRA trains low-rank adapters of the target layers only, the loaded weights are frozen.
+	LoRARank    int      `json:"lora_rank"`    // rank of the adapters, 0 trains all the params
+	LoRAAlpha   float64  `json:"lora_alpha"`   // adapters are scaled by alpha/rank, defaults to rank
+	LoRATargets []string `json:"lora_targets"` // names or globs of the adapted layers, see Model.Linears
+	// Names or globs of the params kept as loaded, e.g. ["*_embeds", "blocks.0", "blocks.1"], see Model.ParamNames.
+	Freeze []string `json:"freeze"`
+}
+
+// LoadConfig overrides the fields of config with the ones present in the JSON file.
+func LoadConfig(config Config, filename string) Config {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields() // typos in field names would be silently ignored otherwise
+	if err := decoder.Decode(&config); err != nil {
+		panic(fmt.Sprintf("invalid config '%s': %v", filename, err))
+	}
+	if config.EvalSteps < 1 {
+		panic(fmt.Sprintf("invalid config '%s': eval_steps must be at least 1, got %d", filename, config.EvalSteps))
+	}
+	if config.Replicas < 1 {
+		panic(fmt.Sprintf("invalid config '%s': replicas must be at least 1, got %d", filename, config.Replicas))
+	}
+
+	return config
+}
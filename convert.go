@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/variable"
+	"github.com/zakirullin/gpt-go/data"
+	"github.com/zakirullin/gpt-go/pkg"
+)
+
+// Converts a checkpoint saved when every attention head had its own Query, Key and Value weights
+// to the fused layout of MultiHeadAttention:
+//
+//	go run . convert -in model-0.512M
+//
+// The number of params is the same, so by default the checkpoint is converted in place
+// and the original one is kept with the ".per-head" suffix. Such checkpoints were trained
+// before pre-norm blocks, the converted model is run with residual set to legacy.
+func convertCmd(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	in := flags.String("in", "", "Checkpoint with per-head attention weights")
+	out := flags.String("out", "", "Converted checkpoint, defaults to -in")
+	configFile := flags.String("config", "", "JSON file overriding the hyperparameters the model was trained with")
+	flags.Parse(args)
+	if *configFile != "" {
+		config = LoadConfig(config, *configFile)
+	}
+	if *in == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	_, vocabSize := data.Tokenize(config.PretrainedTokens)
+	model := NewModel(vocabSize, config.ModelConfig)
+	loadPerHead(model, *in)
+
+	if *out == "" {
+		*out = *in
+		if err := os.Rename(*in, *in+".per-head"); err != nil {
+			panic(err)
+		}
+	}
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	params.SaveAs(*out)
+	fmt.Printf("Converted '%s' to '%s', run it with {\"residual\": \"legacy\"}\n", *in, *out)
+}
+
+// Loads a checkpoint with per-head attention weights into the model.
+// The params were saved in the same order, except for the fused qkv weight of every block,
+// which took the place of the Query, Key and Value weights of the first head, then the second one, etc.
+func loadPerHead(model *Model, filename string) {
+	attentions := make(map[*variable.Variable]*MultiHeadAttention)
+	for _, block := range model.blocks {
+		attentions[block.saHead.qkv.Weight] = block.saHead
+	}
+
+	legacy := pkg.NewParams()
+	var fuse []func()
+	for _, param := range model.Params() {
+		mh, ok := attentions[param]
+		if !ok {
+			legacy.Add(param) // shares the data with the model
+			continue
+		}
+
+		if mh.kvHeads != mh.numHeads {
+			panic("checkpoints with per-head weights have a key and value per query head, set kv_heads to heads")
+		}
+		heads := make([]layer.Parameter, 3*mh.numHeads) // query, key and value of every head
+		for i := range heads {
+			heads[i] = Zeros(mh.embedSize, mh.headSize)
+		}
+		legacy.Add(heads...)
+		fuse = append(fuse, func() { fuseHeads(mh, heads) })
+	}
+
+	legacy.LoadFrom(filename)
+	for _, f := range fuse {
+		f()
+	}
+}
+
+// Copies the query, key and value weights of every head to their columns of the qkv weight.
+func fuseHeads(mh *MultiHeadAttention, heads []layer.Parameter) {
+	for i := range mh.numHeads {
+		for j, weight := range heads[3*i : 3*i+3] { // query, key, value
+			offset := j*mh.numHeads*mh.headSize + i*mh.headSize
+			for r := range weight.Data.Rows {
+				copy(mh.qkv.Weight.Data.Row(r)[offset:], weight.Data.Row(r))
+			}
+		}
+	}
+}
@@ -42,7 +42,7 @@ func Tokenize(numMerges int) ([]float64, int) {
 
 func Encode(s string) []float64 {
 	var tokens []float64
-	for _, ch := range s {
+	for _, ch := range normNewLines(s) {
 		tok, ok := tokenToID[string(ch)]
 		if !ok {
 			panic(fmt.Sprintf("char '%s' is missing from vocabulary", string(ch)))
@@ -110,6 +110,12 @@ func Sample(data []float64, blockSize int) (*variable.Variable, *variable.Variab
 	return variable.New(x...), variable.New(y...)
 }
 
+// Split divides data into two consecutive parts, the first one contains the given ratio of data.
+func Split(data []float64, ratio float64) ([]float64, []float64) {
+	n := int(float64(len(data)) * ratio)
+	return data[:n], data[n:]
+}
+
 func Chars() string {
 	var tokens []string
 	for token := range tokenToID {
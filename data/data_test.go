@@ -131,6 +131,12 @@ func TestSample(t *testing.T) {
 	}, y)
 }
 
+func TestSplit(t *testing.T) {
+	train, val := Split(V{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 0.8)
+	areSlicesEqual(t, []float64{0, 1, 2, 3, 4, 5, 6, 7}, train)
+	areSlicesEqual(t, []float64{8, 9}, val)
+}
+
 func TestNormNewLinesEmptyString(t *testing.T) {
 	input := ""
 	expected := ""
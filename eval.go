@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"unicode/utf8"
+
+	"github.com/itsubaki/autograd/variable"
+	"github.com/zakirullin/gpt-go/data"
+	"github.com/zakirullin/gpt-go/pkg"
+)
+
+// Scores a trained model on a text file:
+//
+//	go run . eval -file book.txt -stride 16
+//
+// Cross-entropy and perplexity depend on the vocabulary, a model with bigger tokens predicts
+// fewer of them. Bits per byte and per char are normalized by the length of the text instead,
+// so they are comparable between models with different vocab sizes.
+func evalCmd(args []string) {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	file := flags.String("file", "", "Text file to evaluate the model on")
+	stride := flags.Int("stride", 0, "Number of tokens the window slides by, every token but the first is scored once, defaults to half the context")
+	checkpoint := flags.String("checkpoint", "", "Checkpoint to load, defaults to the model trained by 'go run .'")
+	configFile := flags.String("config", "", "JSON file overriding the hyperparameters the model was trained with")
+	flags.Parse(args)
+	if *configFile != "" {
+		config = LoadConfig(config, *configFile)
+	}
+	if *file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	text, err := os.ReadFile(*file)
+	if err != nil {
+		panic(err)
+	}
+
+	_, vocabSize := data.Tokenize(config.PretrainedTokens)
+	model := NewModel(vocabSize, config.ModelConfig)
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	if *checkpoint != "" {
+		params.LoadFrom(*checkpoint)
+	} else {
+		params.Load()
+	}
+	if config.LoRARank > 0 {
+		model.AddLoRA(config.LoRARank, config.LoRAAlpha, config.LoRATargets...)
+		newLoRAParams(model).Load()
+	}
+
+	tokens := data.Encode(string(text))
+	if len(tokens) < 2 {
+		panic("not enough tokens to evaluate")
+	}
+	if *stride == 0 {
+		*stride = model.context / 2 // of the loaded config, max_context included
+	}
+	nll, scored := crossEntropy(model, tokens, *stride)
+
+	// Scored tokens are the last ones: all but the first one, or the first P with the prefix:P mask.
+	predicted := data.Decode(tokens[len(tokens)-scored:]...)
+	bytes, chars := len(predicted), utf8.RuneCountInString(predicted)
+
+	fmt.Printf("Tokens: %d, bytes: %d, chars: %d\n", scored, bytes, chars)
+	fmt.Printf("Cross-entropy: %.4f nats/token\n", nll/float64(scored))
+	fmt.Printf("Perplexity: %.4f\n", math.Exp(nll/float64(scored)))
+	fmt.Printf("Bits per byte: %.4f\n", nll/math.Ln2/float64(bytes))
+	fmt.Printf("Bits per char: %.4f\n", nll/math.Ln2/float64(chars))
+}
+
+// Slides a window of the model's context tokens over the text with the given stride and returns
+// the total negative log-likelihood (in nats) of the scored tokens and their number.
+// Every token but the first one is scored exactly once, with as much context as the
+// window allows: smaller stride gives more context, but takes more forward passes.
+// With the prefix:P mask the first P tokens aren't scored, the prefix sees the tokens it predicts,
+// and the stride is limited, so the tokens scored by every window are after its prefix.
+func crossEntropy(model *Model, tokens []float64, stride int) (float64, int) {
+	defer variable.Nograd().End()
+	defer variable.TestMode().End()
+
+	stride = max(1, min(stride, model.context-model.firstScored(model.context)))
+	var nll float64
+	scored, count := 0, 0 // targets are tokens[1:], so tokens[1:scored+1] have been considered
+	for begin := 0; scored < len(tokens)-1; begin += stride {
+		end := min(begin+model.context, len(tokens)-1)
+		logits := model.Forward(tokens[begin:end]...)
+
+		// Only the targets not scored by the previous windows.
+		for i := max(scored-begin, model.firstScored(end-begin)); i < end-begin; i++ {
+			nll += logSumExp(logits.Data.Row(i)) - logits.Data.At(i, int(tokens[begin+i+1]))
+			count++
+		}
+		scored = end
+	}
+
+	return nll, count
+}
+
+func logSumExp(row []float64) float64 {
+	maxVal := math.Inf(-1)
+	for _, v := range row {
+		maxVal = max(maxVal, v)
+	}
+
+	var sum float64
+	for _, v := range row {
+		sum += math.Exp(v - maxVal)
+	}
+
+	return maxVal + math.Log(sum)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/matrix"
 	"github.com/itsubaki/autograd/variable"
 	"github.com/zakirullin/gpt-go/pkg"
 )
@@ -11,87 +13,260 @@ import (
 var (
 	Tril          = pkg.Tril
 	MaskedInfFill = pkg.MaskedInfFill
+	Masked        = pkg.Masked
+	RoPE          = pkg.RoPE
 )
 
 type MultiHeadAttention struct {
 	numHeads  int
 	embedSize int
 	headSize  int
+	kvHeads   int // number of key and value heads, each shared by numHeads/kvHeads query heads
 	Heads     []*Head
+	qkv       *Linear // queries, keys and values of all the heads at once
 	proj      *Linear
+	dropout   float64
+	rope      bool
+	alibi     bool
+	mask      AttentionMask
+	flash     bool
+	doubled   bool
 }
 
-func NewMultiHeadAttention(embedSize, numHeads int) *MultiHeadAttention {
-	heads := make([]*Head, numHeads)
-	headSize := embedSize / numHeads
-	for i := range heads {
-		heads[i] = NewHead(embedSize, headSize)
+type AttentionOption func(*MultiHeadAttention)
+
+// AttentionDropout disables the given fraction of attentions and outputs during training.
+func AttentionDropout(ratio float64) AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.dropout = ratio
+	}
+}
+
+// WithRoPE rotates queries and keys by their positions, see pkg.RoPE.
+func WithRoPE() AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.rope = true
 	}
+}
+
+// WithALiBi penalizes the attention scores linearly by the distance between the tokens,
+// with a different slope per head: 2^(-8/numHeads), 2^(-16/numHeads), ..., 2^-8.
+func WithALiBi() AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.alibi = true
+	}
+}
 
-	return &MultiHeadAttention{
-		Heads:     heads,
+// WithMask sets the tokens every token attends to, CausalMask by default.
+func WithMask(mask AttentionMask) AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.mask = mask
+	}
+}
+
+// WithKVHeads shares keys and values between groups of query heads: grouped-query attention,
+// or multi-query attention with a single key and value head. It shrinks the projection
+// and the KVCache by numHeads/kvHeads times.
+func WithKVHeads(kvHeads int) AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.kvHeads = kvHeads
+	}
+}
+
+// WithFlashAttention computes the attention of every head by pkg.FlashAttention, which doesn't store
+// the (T, T) matrix of attentions, so longer blocks fit in memory. Dropout of the attentions needs
+// the matrix, so the plain attention is used when training with dropout.
+func WithFlashAttention() AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.flash = true
+	}
+}
+
+// WithDoubledScores doubles the attention scores, as the masking did before it was fixed.
+// Models trained by those versions learned weights for the doubled scores, so they need it to compute the same.
+func WithDoubledScores() AttentionOption {
+	return func(mh *MultiHeadAttention) {
+		mh.doubled = true
+	}
+}
+
+// The queries, keys and values of every head are computed by a single projection: columns of the queries
+// of all the heads go first, then the keys, then the values, headSize columns per head.
+// It's the same math as a Linear per head, but one big matmul instead of many small ones.
+func NewMultiHeadAttention(embedSize, numHeads int, opts ...AttentionOption) *MultiHeadAttention {
+	headSize := embedSize / numHeads
+	mh := &MultiHeadAttention{
 		numHeads:  numHeads,
 		embedSize: embedSize,
 		headSize:  headSize,
+		kvHeads:   numHeads,
 		proj:      NewLinear(embedSize, embedSize),
+		mask:      CausalMask(),
+	}
+	for _, opt := range opts {
+		opt(mh)
+	}
+	if mh.kvHeads < 1 || numHeads%mh.kvHeads != 0 {
+		panic(fmt.Sprintf("%d heads can't be split into groups of %d key and value heads", numHeads, mh.kvHeads))
+	}
+	mh.qkv = NewLinear(embedSize, (numHeads+2*mh.kvHeads)*headSize, NoBias())
+
+	mh.Heads = make([]*Head, numHeads)
+	for i := range mh.Heads {
+		mh.Heads[i] = &Head{embedSize: embedSize, headSize: headSize, dropout: mh.dropout, mask: mh.mask, flash: mh.flash, doubled: mh.doubled}
+		if mh.alibi {
+			mh.Heads[i].slope = math.Pow(2, -8*float64(i+1)/float64(numHeads))
+		}
 	}
+
+	return mh
 }
 
 func (mh *MultiHeadAttention) Forward(input *variable.Variable) *variable.Variable {
+	return mh.ForwardCached(input, nil)
+}
+
+// ForwardCached is Forward for the tokens following the ones in the cache, with a KVCache per key and value head.
+// The tokens attend to themselves and to the cached tokens, then their keys and values are appended to the cache.
+// A nil cache means no caching. Cached keys and values are plain data, so the gradient doesn't flow through them:
+// the cache is meant for generation, where each new token costs a single row of attentions.
+func (mh *MultiHeadAttention) ForwardCached(input *variable.Variable, cache []*KVCache) *variable.Variable {
+	// Queries of every head, then keys of every key and value head, then values.
+	qkv := pkg.Split(mh.qkv.Forward(input), mh.numHeads+2*mh.kvHeads)
+	queries, keys, values := qkv[:mh.numHeads], qkv[mh.numHeads:mh.numHeads+mh.kvHeads], qkv[mh.numHeads+mh.kvHeads:]
+
+	past := 0 // number of tokens processed before
+	if cache != nil {
+		past = cache[0].Len()
+	}
+	for i := range mh.kvHeads {
+		if mh.rope {
+			keys[i] = RoPE(past)(keys[i])
+		}
+		if cache != nil {
+			keys[i], values[i] = cache[i].append(keys[i], values[i])
+		}
+	}
+
 	var features []*variable.Variable
-	for _, head := range mh.Heads {
-		features = append(features, head.Forward(input))
+	groupSize := mh.numHeads / mh.kvHeads
+	for i, head := range mh.Heads {
+		query := queries[i]
+		if mh.rope {
+			query = RoPE(past)(query)
+		}
+		features = append(features, head.Forward(query, keys[i/groupSize], values[i/groupSize], past))
 	}
 
 	out := pkg.Cat(features...)
-	out = mh.proj.Forward(out)  // Project back to (embedSize, embedSize)
-	out = Dropout(dropout)(out) // Dropping out some neurons to prevent overfitting
+	out = mh.proj.Forward(out)     // Project back to (embedSize, embedSize)
+	out = Dropout(mh.dropout)(out) // Dropping out some neurons to prevent overfitting
 
 	return out
 }
 
 func (mh *MultiHeadAttention) Params() []layer.Parameter {
-	var params []layer.Parameter
-	for _, head := range mh.Heads {
-		params = append(params, head.Query.Weight, head.Key.Weight, head.Value.Weight)
-	}
-	params = append(params, mh.proj.Weight, mh.proj.Bias)
-
-	return params
+	return []layer.Parameter{mh.qkv.Weight, mh.proj.Weight, mh.proj.Bias}
 }
 
+// Head is the attention of a single head over the queries, keys and values projected by MultiHeadAttention.
 type Head struct {
 	embedSize int
 	headSize  int
-	Key       *Linear
-	Query     *Linear
-	Value     *Linear
-}
-
-// Number of embeds
-func NewHead(embedSize, headSize int) *Head {
-	key := NewLinear(embedSize, headSize, NoBias())
-	query := NewLinear(embedSize, headSize, NoBias())
-	value := NewLinear(embedSize, headSize, NoBias())
-
-	return &Head{embedSize, headSize, key, query, value}
+	dropout   float64
+	slope     float64 // ALiBi penalty per token of distance, 0 disables it
+	mask      AttentionMask
+	flash     bool
+	doubled   bool // scores are doubled, see WithDoubledScores
 }
 
 // Self-attention mechanism, see main_test.go for explanation.
-func (h *Head) Forward(input *variable.Variable) *variable.Variable {
-	query := h.Query.Forward(input)
-	key := h.Key.Forward(input)
+// Queries are of the new tokens, keys and values are of the past tokens followed by the new ones.
+func (h *Head) Forward(query, key, v *variable.Variable, past int) *variable.Variable {
+	if h.flash && (h.dropout == 0 || !variable.Config.Train) {
+		return h.flashForward(query, key, v, past)
+	}
+
 	attentions := MatMul(query, Transpose(key))
+	if h.doubled {
+		attentions = MulC(2, attentions)
+	}
 
-	T := input.N() // number of tokens
-	tril := Tril(Ones(T, T))
-	attentions = MaskedInfFill(attentions, tril)
+	T := query.N() // number of tokens
+	if h.slope != 0 {
+		attentions = Add(attentions, alibiBias(T, past, h.slope))
+	}
+	attentions = Masked(func(i, j int) bool { // query i is at position past+i
+		return h.mask(past+i, j)
+	})(attentions)
 	attentions = Softmax(attentions)
-	attentions = Dropout(dropout)(attentions)
+	attentions = Dropout(h.dropout)(attentions)
 
-	v := h.Value.Forward(input)
 	weightedSum := MatMul(attentions, v)
 	normalizedSum := MulC(math.Pow(float64(h.embedSize), -0.5), weightedSum)
 
 	return normalizedSum
 }
+
+// Same as Forward, but in tiles without the (T, T) attentions, see pkg.FlashAttention.
+func (h *Head) flashForward(query, key, v *variable.Variable, past int) *variable.Variable {
+	allowed := func(i, j int) bool { return h.mask(past+i, j) }
+	var bias func(i, j int) float64
+	if h.slope != 0 {
+		bias = func(i, j int) float64 { return -h.slope * math.Abs(float64(past+i-j)) }
+	}
+
+	if h.doubled {
+		query = MulC(2, query) // doubles the scores
+	}
+
+	weightedSum := pkg.FlashAttention(allowed, bias)(query, key, v)
+	return MulC(math.Pow(float64(h.embedSize), -0.5), weightedSum)
+}
+
+// KVCache holds the keys and values of the tokens already processed by a Head.
+type KVCache struct {
+	keys, values *matrix.Matrix
+}
+
+// Len returns the number of cached tokens.
+func (c *KVCache) Len() int {
+	if c.keys == nil {
+		return 0
+	}
+
+	return c.keys.Rows
+}
+
+// Appends the keys and values of the new tokens, returns the keys and values of all the tokens.
+func (c *KVCache) append(key, value *variable.Variable) (*variable.Variable, *variable.Variable) {
+	c.keys = appendRows(c.keys, key.Data)
+	c.values = appendRows(c.values, value.Data)
+
+	return variable.NewFrom(c.keys), variable.NewFrom(c.values)
+}
+
+func appendRows(m, rows *matrix.Matrix) *matrix.Matrix {
+	if m == nil {
+		m = matrix.Zero(0, rows.Cols)
+	}
+
+	data := make([]float64, 0, len(m.Data)+len(rows.Data))
+	data = append(data, m.Data...)
+	data = append(data, rows.Data...)
+
+	return &matrix.Matrix{Rows: m.Rows + rows.Rows, Cols: m.Cols, Data: data}
+}
+
+// Returns (T, past+T) biases -slope*|i-j| of the query i and the key j, distances are counted
+// from the positions past+i of the queries. Future keys are penalized too, the mask may allow them.
+func alibiBias(T, past int, slope float64) *variable.Variable {
+	bias := Zeros(T, past+T)
+	for i := range T {
+		for j := range past + T {
+			bias.Data.Set(i, j, -slope*math.Abs(float64(past+i-j)))
+		}
+	}
+
+	return bias
+}
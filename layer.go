@@ -20,6 +20,7 @@ type Linear struct {
 	Weight  *variable.Variable
 	Biased  bool
 	Bias    *variable.Variable
+	lora    *LoRA // trainable update of the frozen weight, nil unless fine-tuned with LoRA
 }
 
 func NewLinear(in, out int, opts ...LinearOption) *Linear {
@@ -45,6 +46,9 @@ func (l *Linear) Forward(input *variable.Variable) *variable.Variable {
 	if l.Biased {
 		logits = Add(logits, l.Bias)
 	}
+	if l.lora != nil {
+		logits = Add(logits, l.lora.Forward(input))
+	}
 
 	return logits
 }
@@ -71,6 +75,12 @@ func NoBias() LinearOption {
 	}
 }
 
+// Norm normalizes every token's embed, e.g. LayerNorm or RMSNorm.
+type Norm interface {
+	Forward(x *variable.Variable) *variable.Variable
+	Params() []layer.Parameter
+}
+
 type LayerNorm struct {
 	Scale *variable.Variable
 	Shift *variable.Variable
@@ -85,15 +95,10 @@ func NewLayerNorm(dim int) *LayerNorm {
 	}
 }
 
-// It is implemented using existing primitives, so back propagation will work
+// It is a single fused function, computing the same as the primitives:
+// Scale * (x - Mean(x)) / Pow(0.5)(Variance(x) + eps) + Shift, see main_test.go.
 func (ln *LayerNorm) Forward(x *variable.Variable) *variable.Variable {
-	xmean := Mean(x)
-	xvar := Variance(x)
-	eps := variable.New(ln.eps)
-	xhat := Div(Sub(x, xmean), Pow(0.5)(Add(xvar, eps)))
-	out := Add(Mul(ln.Scale, xhat), ln.Shift)
-
-	return out
+	return pkg.LayerNorm(ln.eps)(x, ln.Scale, ln.Shift)
 }
 
 func (ln *LayerNorm) Params() []layer.Parameter {
@@ -102,3 +107,26 @@ func (ln *LayerNorm) Params() []layer.Parameter {
 		ln.Shift,
 	}
 }
+
+// RMSNorm is LayerNorm without centering and shift: Scale * x / sqrt(mean(x²) + eps).
+type RMSNorm struct {
+	Scale *variable.Variable
+	eps   float64
+}
+
+func NewRMSNorm(dim int) *RMSNorm {
+	return &RMSNorm{
+		eps:   1e-05,
+		Scale: Ones(1, dim),
+	}
+}
+
+func (n *RMSNorm) Forward(x *variable.Variable) *variable.Variable {
+	return pkg.RMSNorm(n.eps)(x, n.Scale)
+}
+
+func (n *RMSNorm) Params() []layer.Parameter {
+	return []layer.Parameter{
+		n.Scale,
+	}
+}
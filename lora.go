@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+	"github.com/zakirullin/gpt-go/data"
+	"github.com/zakirullin/gpt-go/pkg"
+)
+
+// LoRA is a trainable low-rank update of a frozen Linear weight: x·W + scale·x·A·B, where A is (in, rank)
+// and B is (rank, out), so the update has (in+out)*rank params instead of in*out. B starts at zeros,
+// so a model with new adapters computes the same as without them.
+type LoRA struct {
+	A, B  *variable.Variable
+	scale float64 // alpha/rank
+}
+
+func NewLoRA(in, out, rank int, alpha float64) *LoRA {
+	return &LoRA{
+		A:     RandWeights(in, rank),
+		B:     Zeros(rank, out),
+		scale: alpha / float64(rank),
+	}
+}
+
+func (l *LoRA) Forward(input *variable.Variable) *variable.Variable {
+	return MulC(l.scale, MatMul(MatMul(input, l.A), l.B))
+}
+
+// Returns scale·A·B, the update of the weight.
+func (l *LoRA) delta() *matrix.Matrix {
+	return matrix.MulC(l.scale, matrix.Dot(l.A.Data, l.B.Data))
+}
+
+// AddLoRA attaches adapters to the Linears matching any of the targets, see Linears for the names.
+// A target matches the full name, its last part (e.g. "qkv" matches every "blocks.N.attention.qkv"),
+// or is a glob of the full name (e.g. "blocks.0.*"). Alpha defaults to rank.
+func (m *Model) AddLoRA(rank int, alpha float64, targets ...string) {
+	if alpha == 0 {
+		alpha = float64(rank)
+	}
+
+	for _, target := range targets {
+		matched := false
+		for _, linear := range m.Linears() {
+			if !matches(target, linear.Name) {
+				continue
+			}
+			matched = true
+			if linear.lora == nil {
+				linear.lora = NewLoRA(linear.In, linear.Out, rank, alpha)
+			}
+		}
+		if !matched {
+			panic(fmt.Sprintf("no layers match the LoRA target '%s'", target))
+		}
+	}
+	m.lora = &loraConfig{rank: rank, alpha: alpha, targets: targets}
+}
+
+// LoRAParams returns A and B of every adapter, in the order of Linears.
+func (m *Model) LoRAParams() []layer.Parameter {
+	var params []layer.Parameter
+	for _, linear := range m.Linears() {
+		if linear.lora != nil {
+			params = append(params, linear.lora.A, linear.lora.B)
+		}
+	}
+
+	return params
+}
+
+// Trainable returns the params updated by the training: the adapters if there are any, all the params otherwise.
+func (m *Model) Trainable() []layer.Parameter {
+	if m.lora != nil {
+		return m.LoRAParams()
+	}
+
+	return m.Params()
+}
+
+// MergeLoRA folds the adapters into the weights, W = W + scale·A·B, and removes them.
+func (m *Model) MergeLoRA() {
+	for _, linear := range m.Linears() {
+		if linear.lora == nil {
+			continue
+		}
+		linear.Weight.Data = matrix.Add(linear.Weight.Data, linear.lora.delta())
+		linear.lora = nil
+	}
+	m.lora = nil
+}
+
+// NamedLinear is a Linear layer of the model with its name, e.g. "blocks.0.attention.qkv" or "lm_head".
+type NamedLinear struct {
+	Name string
+	*Linear
+}
+
+// Linears returns the Linear layers of the model in a stable order.
+func (m *Model) Linears() []NamedLinear {
+	var linears []NamedLinear
+	add := func(name string, l *Linear) {
+		if l != nil {
+			linears = append(linears, NamedLinear{Name: name, Linear: l})
+		}
+	}
+
+	for i, block := range m.blocks {
+		prefix := fmt.Sprintf("blocks.%d.", i)
+		add(prefix+"attention.qkv", block.saHead.qkv)
+		add(prefix+"attention.proj", block.saHead.proj)
+		add(prefix+"mlp", block.mlp)
+		add(prefix+"mlp_gate", block.mlpGate)
+		add(prefix+"mlp_proj", block.mlpProj)
+		if block.moe != nil {
+			add(prefix+"moe.router", block.moe.router)
+			for j, expert := range block.moe.experts {
+				expertPrefix := fmt.Sprintf("%smoe.experts.%d.", prefix, j)
+				add(expertPrefix+"mlp", expert.mlp)
+				add(expertPrefix+"mlp_gate", expert.mlpGate)
+				add(expertPrefix+"mlp_proj", expert.mlpProj)
+			}
+		}
+	}
+	add("lm_head", m.lmHead)
+
+	return linears
+}
+
+func matches(target, name string) bool {
+	if target == name || strings.HasSuffix(name, "."+target) {
+		return true
+	}
+	matched, err := path.Match(target, name)
+	if err != nil {
+		panic(fmt.Sprintf("invalid LoRA target '%s': %v", target, err))
+	}
+
+	return matched
+}
+
+// Settings of the attached adapters, so replicas get the same ones.
+type loraConfig struct {
+	rank    int
+	alpha   float64
+	targets []string
+}
+
+// Returns the adapter params of the model, saved to and loaded from their own "lora-X.XXXM" files.
+// They are named after their layers: "blocks.0.attention.qkv.lora_a" and "blocks.0.attention.qkv.lora_b".
+func newLoRAParams(model *Model) *pkg.Params {
+	params := pkg.NewParams().Named("lora")
+	var names []string
+	for _, linear := range model.Linears() {
+		if linear.lora != nil {
+			params.Add(linear.lora.A, linear.lora.B)
+			names = append(names, linear.Name+".lora_a", linear.Name+".lora_b")
+		}
+	}
+	params.SetNames(names...)
+
+	return params
+}
+
+// Folds fine-tuned adapters into the base weights:
+//
+//	go run . merge -config lora.json
+//
+// The config is the one of the fine-tuning, with lora_rank set. By default the base checkpoint
+// is merged in place and the original one is kept with the ".base" suffix. The merged model
+// has no adapters, so it's used with lora_rank removed from the config.
+func mergeCmd(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file with the hyperparameters of the fine-tuning")
+	base := flags.String("base", "", "Base checkpoint, defaults to the model trained by 'go run .'")
+	adapters := flags.String("adapters", "", "Adapters checkpoint, defaults to the adapters trained by 'go run .'")
+	out := flags.String("out", "", "Merged checkpoint, defaults to -base")
+	flags.Parse(args)
+	if *configFile != "" {
+		config = LoadConfig(config, *configFile)
+	}
+	if config.LoRARank == 0 {
+		panic("lora_rank isn't set, there are no adapters to merge")
+	}
+
+	_, vocabSize := data.Tokenize(config.PretrainedTokens)
+	model := NewModel(vocabSize, config.ModelConfig)
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	if *base == "" {
+		*base = params.Filename()
+	}
+	params.LoadFrom(*base)
+
+	model.AddLoRA(config.LoRARank, config.LoRAAlpha, config.LoRATargets...)
+	lora := newLoRAParams(model)
+	if *adapters == "" {
+		*adapters = lora.Filename()
+	}
+	lora.LoadFrom(*adapters)
+	model.MergeLoRA()
+
+	if *out == "" {
+		*out = *base
+		if err := os.Rename(*base, *base+".base"); err != nil {
+			panic(err)
+		}
+	}
+	params.SaveAs(*out)
+	fmt.Printf("Merged '%s' into '%s', saved to '%s'\n", *adapters, *base, *out)
+}
@@ -4,146 +4,383 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/itsubaki/autograd/variable"
 	"github.com/zakirullin/gpt-go/data"
 	"github.com/zakirullin/gpt-go/pkg"
 )
 
-// Hyperparameters
-const (
-	blockSize        = 32
-	embedSize        = 88
-	heads            = 4
-	layers           = 4
-	learningRate     = 0.0001
-	steps            = 80000 // number of training steps, increase for better results
-	evalSteps        = 1000  // evaluate loss once per every evalSteps
-	dropout          = 0.0   // disable some % of our neurons to prevent overfitting, model is likely to generalize
-	pretrainedTokens = 6000  // number of pretrained tokens to add on top of auto-detected characters
-	maxTokens        = 50    // tokens limit for generation
-)
+// Hyperparameters, see Config for the descriptions. Can be overridden with "-config file.json".
+var config = Config{
+	ModelConfig: ModelConfig{
+		BlockSize: 32,
+		EmbedSize: 88,
+		Heads:     4,
+		Layers:    4,
+		Dropout:   0.0,
+		Positions: LearnedPositions,
+	},
+	LearningRate:     0.0001,
+	Steps:            80000, // increase for better results
+	EvalSteps:        1000,
+	EvalIters:        20,
+	PretrainedTokens: 6000,
+	MaxTokens:        50,
+	EMADecay:         0.999,
+	ValFraction:      0.1,
+	Patience:         10,
+	AutosaveSteps:    5000,
+	KeepCheckpoints:  3,
+	Replicas:         1,
+	LoRATargets:      []string{"qkv"},
+}
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "eval":
+			evalCmd(os.Args[2:])
+			return
+		case "sweep":
+			sweepCmd(os.Args[2:])
+			return
+		case "convert":
+			convertCmd(os.Args[2:])
+			return
+		case "merge":
+			mergeCmd(os.Args[2:])
+			return
+		}
+	}
+
 	// Skip training if "-chat" flag is provided.
-	steps := steps
 	chat := flag.Bool("chat", false, "Skip training and jump straight to chat")
+	noChat := flag.Bool("no-chat", false, "Exit after training instead of jumping to chat")
+	configFile := flag.String("config", "", "JSON file overriding the hyperparameters, e.g. {\"embed_size\": 64}")
+	interruptChat := flag.Bool("interrupt-chat", false, "Jump to chat when training is interrupted, instead of exiting")
+	metricsJSONL := flag.String("metrics-jsonl", "", "Write training metrics to the given JSONL file")
+	metricsCSV := flag.String("metrics-csv", "", "Write training metrics to the given CSV file")
+	tensorboardDir := flag.String("tensorboard", "", "Write TensorBoard events to the given directory")
+	resume := flag.String("resume", "", "Continue the training from a checkpoint saved by autosave or Ctrl-C, e.g. model-0.512M-step5000")
+	detectAnomaly := flag.Bool("detect-anomaly", false, "Report the first operation producing NaN or Inf values, slows down the training")
 	flag.Parse()
+	if *configFile != "" {
+		config = LoadConfig(config, *configFile)
+	}
+	steps := config.Steps
 	if *chat {
 		steps = -1
 	}
+	if *detectAnomaly {
+		defer pkg.DetectAnomaly().End()
+	}
 
 	// Loading dataset and building vocabulary.
 	fmt.Println("Tokenizing dataset...")
-	dataset, vocabSize := data.Tokenize(pretrainedTokens)
+	dataset, vocabSize := data.Tokenize(config.PretrainedTokens)
 	fmt.Printf("First characters:\n%s\n", strings.TrimSpace(data.Decode(dataset[:45]...)))
 	fmt.Printf("Vocabulary: %s\n", data.Chars())
 	fmt.Printf("Tokens in dataset: %.3fM\n", pkg.Millions(len(dataset)))
 
+	// Hold out the tail of the dataset to measure how well the model generalizes.
+	trainData, valData := data.Split(dataset, 1-config.ValFraction)
+
 	// Basic transformer components.
-	tokEmbeds := RandEmbeds(vocabSize, embedSize)
-	posEmbeds := RandEmbeds(blockSize, embedSize)
-	var blocks []*Block
-	for range layers {
-		blocks = append(blocks, NewBlock(embedSize, heads))
-	}
-	norm := NewLayerNorm(embedSize)
-	lmHead := NewLinear(embedSize, vocabSize)
+	model := NewModel(vocabSize, config.ModelConfig)
 
 	// Collecting all the parameters.
 	params := pkg.NewParams()
-	params.Add(tokEmbeds, posEmbeds)
-	for _, block := range blocks {
-		params.Add(block.Params()...)
+	params.Add(model.Params()...)
+	params.SetNames(model.ParamNames()...)
+	if config.LoRARank > 0 {
+		params.Load() // adapters fine-tune a trained model, it must exist
+		fmt.Printf("Loaded base params: %s\n", params.Filename())
+	} else {
+		params.TryLoadPretrained()
+	}
+	params.Freeze(config.Freeze...) // frozen params keep their values
+	printSize("Model", params)
+	if config.LoRARank > 0 {
+		// Fine-tuning trains only the adapters, they are saved to their own small files.
+		model.AddLoRA(config.LoRARank, config.LoRAAlpha, config.LoRATargets...)
+		params = newLoRAParams(model)
+		params.TryLoadPretrained()
+		fmt.Printf("LoRA adapters size: %.3fM, the rest is frozen\n", pkg.Millions(params.Count()))
+	}
+	if *resume != "" {
+		params.LoadFrom(*resume) // the optimizer state starts anew
+		fmt.Printf("Resumed from checkpoint: %s\n", *resume)
 	}
-	params.Add(norm.Params()...)
-	params.Add(lmHead.Params()...)
-	params.TryLoadPretrained()
-	fmt.Printf("Model size: %.3fM\n", pkg.Millions(params.Count()))
+
+	// Training metrics are printed to the terminal and optionally written to files for plotting.
+	sinks := pkg.Sinks{pkg.NewTerminalSink(os.Stdout, config.EvalSteps)}
+	if *metricsJSONL != "" {
+		sinks = append(sinks, pkg.NewJSONLSink(createFile(*metricsJSONL)))
+	}
+	if *metricsCSV != "" {
+		sinks = append(sinks, pkg.NewCSVSink(createFile(*metricsCSV)))
+	}
+	var tb *pkg.TensorBoard
+	if *tensorboardDir != "" {
+		tb = pkg.NewTensorBoard(*tensorboardDir)
+		sinks = append(sinks, tb)
+	}
+	prompt := " mysterious island"
+
+	// Every replica processes its own sample in parallel, gradients are averaged into the params.
+	var replicaModels []*Model
+	var replicaParams []*pkg.Params
+	for range config.Replicas {
+		replica := model.Replica()
+		rparams := pkg.NewParams()
+		rparams.Add(replica.Trainable()...)
+		replicaModels = append(replicaModels, replica)
+		replicaParams = append(replicaParams, rparams)
+	}
+	dataParallel := pkg.NewDataParallel(params, replicaParams...)
 
 	// Training loop.
-	start, now := time.Now(), time.Now()
-	optimizer := pkg.NewAdamW(learningRate)
-	var losses float64
-	fmt.Printf("bs=%d, es=%d, lr=%.4f, vs=%d, steps=%d\n", blockSize, embedSize, learningRate, vocabSize, steps)
+	start := time.Now()
+	optimizer := pkg.NewAdamW(config.LearningRate)
+	ema := pkg.NewEMA(params, config.EMADecay) // smoothed copy of the weights, less noisy than the weights of the last step
+	bestLoss, bestStep, evalsWithoutImprovement := math.Inf(1), 0, 0
+	checkpoints := pkg.NewCheckpoints(params, config.KeepCheckpoints) // raw weights, not averaged, so the training can be resumed
+	// Ctrl-C doesn't kill the training, the current step is finished and a checkpoint is saved.
+	// The second Ctrl-C kills it right away.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	interrupting := make(chan struct{})
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		close(interrupting)
+	}()
+	interrupted, stopped := false, false
+	fmt.Printf("bs=%d, es=%d, lr=%.4f, vs=%d, steps=%d\n", config.BlockSize, config.EmbedSize, config.LearningRate, vocabSize, steps)
 	for i := range steps {
-		// Targets contain the ground truth next token for each input token.
-		input, targets := data.Sample(dataset, blockSize)
-
-		// Forward pass, calculate predictions for every input token.
-		embeds := Rows(tokEmbeds, Flat(input)...) // get embed for every input token
-		embeds = Add(embeds, posEmbeds)           // add positional embedding
-		for _, block := range blocks {            // self-attention and feed-forward
-			embeds = block.Forward(embeds)
-		}
-		embeds = norm.Forward(embeds)
-		logits := lmHead.Forward(embeds) // get scores for the next token for every context-enriched embed
-
-		// Loss calculation, "how much our predicted targets differ from the ground truth targets?"
-		// We average the loss over evalSteps iterations to smooth out fluctuations.
-		loss := SoftmaxCrossEntropy(logits, targets)
-		losses += Val(loss)
-		fmt.Printf("\r%s", strings.Repeat("·", (i%evalSteps)*26/evalSteps)) // progress bar
-		if i%evalSteps == 0 {
-			avgLoss := losses / float64(min(i+1, evalSteps))
-			fmt.Printf("\rstep: %5d, loss: %.4f, time: %s\n", i, avgLoss, time.Since(now))
-			losses, now = 0, time.Now()
-		}
+		stepStart := time.Now()
+		loss := dataParallel.Step(func(r int) *variable.Variable {
+			// Targets contain the ground truth next token for each input token.
+			input, targets := data.Sample(trainData, config.BlockSize)
+
+			// Forward pass, calculate predictions for every input token.
+			logits := replicaModels[r].Forward(Flat(input)...)
 
-		// Backward pass, calculate the gradients (how much each parameter contributes to the loss)
-		// for all the parameters (weights, biases, embeds). Loss is the tail of a computation graph.
-		loss.Backward()
+			// Loss calculation, "how much our predicted targets differ from the ground truth targets?"
+			loss := SoftmaxCrossEntropy(replicaModels[r].Scored(logits, targets))
+			if aux := replicaModels[r].AuxLoss(); aux != nil {
+				loss = Add(loss, aux) // keeps the experts evenly loaded
+			}
+
+			return loss
+		})
+		// Backward pass was done by the replicas, it calculates the gradients (how much each parameter
+		// contributes to the loss) for all the parameters (weights, biases, embeds).
+		// Loss is the tail of a computation graph.
+		gradNorm := params.GradNorm()
+		if tb != nil && i%config.EvalSteps == 0 {
+			for name, param := range params.ByName() {
+				tb.Histogram("weights/"+name, i, Flat(param))
+				if param.Grad != nil {
+					tb.Histogram("grads/"+name, i, Flat(param.Grad))
+				}
+			}
+		}
 		// Nudge the parameters in the direction of the gradients, so to minimize the loss.
-		optimizer.Update(params)
+		// A single NaN would corrupt every parameter, so such updates are skipped.
+		switch {
+		case !pkg.IsFinite(loss) && (checkpoints.Last() != "" || !math.IsInf(bestLoss, 1)):
+			fmt.Printf("\rNon-finite loss at step %d, rolled back to: %s\n", i, rollback(params, checkpoints, &optimizer, ema))
+		case !pkg.IsFinite(loss, gradNorm):
+			fmt.Printf("\rNon-finite loss or gradients at step %d, skipping the update\n", i)
+		default:
+			optimizer.Update(params)
+			ema.Update()
+		}
 		params.ZeroGrad()
-	}
-	fmt.Printf("\rTraining time: %s\n", time.Since(start))
+		stepTime := time.Since(stepStart)
 
-	params.Save()
-	pkg.DisableDropout()
-	// Training is done.
+		valLoss := math.NaN()
+		if i%config.EvalSteps == 0 {
+			valLoss = evaluate(model, ema, valData)
+			if tb != nil {
+				tb.Text("sample", i, generate(model, ema, prompt))
+			}
 
-	// Predicts the next token based on the context of tokens.
-	nextTok := func(context []float64) float64 {
-		context = context[max(0, len(context)-blockSize):]
+			// Keep only the best checkpoint, stop when the model no longer improves on unseen data.
+			if valLoss < bestLoss {
+				bestLoss, bestStep, evalsWithoutImprovement = valLoss, i, 0
+				span := ema.Apply()
+				params.Save()
+				span.End()
+			} else if evalsWithoutImprovement++; evalsWithoutImprovement >= config.Patience {
+				stopped = true
+			}
+		}
+
+		sinks.Log(pkg.Metrics{
+			Step:         i,
+			Loss:         loss,
+			ValLoss:      valLoss,
+			LearningRate: optimizer.Alpha,
+			GradNorm:     gradNorm,
+			TokensPerSec: float64(config.BlockSize*config.Replicas) / stepTime.Seconds(),
+			Time:         time.Since(start),
+		})
 
-		// Feed context tokens to the model.
-		embeds := Rows(tokEmbeds, context...)
-		embeds = Add(embeds, posEmbeds)
-		for _, block := range blocks {
-			embeds = block.Forward(embeds)
+		if config.AutosaveSteps > 0 && (i+1)%config.AutosaveSteps == 0 {
+			checkpoints.Save(i + 1)
 		}
-		embeds = norm.Forward(embeds)
-		logits := lmHead.Forward(embeds) // get a list of final logits for the next token
 
-		// We only care about the probabilities of the next token for the last token.
-		logitsForNextToken := Rows(logits, -1)
-		probs := Softmax(logitsForNextToken)
-		tok := pkg.SampleTemp(probs, 0.8)
+		select {
+		case <-interrupting:
+			fmt.Printf("\rInterrupted, saved checkpoint: %s\n", checkpoints.Save(i+1))
+			interrupted = true
+		default:
+		}
+		if stopped {
+			fmt.Printf("No improvement for %d evaluations, stopping early\n", config.Patience)
+		}
+		if interrupted || stopped {
+			break
+		}
+	}
+	signal.Stop(interrupt) // Ctrl-C kills the program again
+	sinks.Close()
+	fmt.Printf("\rTraining time: %s\n", time.Since(start))
 
-		return tok
+	switch {
+	case steps > 0 && !math.IsInf(bestLoss, 1):
+		fmt.Printf("Best step: %d, val loss: %.4f\n", bestStep, bestLoss)
+		params.Load() // restore the best checkpoint
+	case steps > 0:
+		fmt.Println("No finite val loss, the best checkpoint wasn't saved, keeping the last weights")
+	}
+	if *noChat || (interrupted && !*interruptChat) {
+		return
 	}
+	pkg.DisableDropout()
+	// Training is done.
 
 	// Sample from the model.
-	prompt := " mysterious island"
 	for {
 		fmt.Printf("\n%s", prompt)
 		context := data.Encode(prompt)
-		for range maxTokens {
-			nextToken := nextTok(context)
+		cache := model.NewCache()
+		for range config.MaxTokens {
+			nextToken := nextTok(model, cache, context)
 			fmt.Print(data.Decode(nextToken))
 			context = append(context, nextToken)
 		}
 
 		fmt.Print("\n$ ")
 		scanner := bufio.NewScanner(os.Stdin)
-		scanner.Scan()
-		prompt = scanner.Text()
-		if prompt == "exit" {
+		if !scanner.Scan() || scanner.Text() == "exit" { // stdin is closed or user wants to exit
 			fmt.Println("Bye!")
 			break
 		}
+		prompt = scanner.Text()
 	}
 }
+
+// Predicts the next token based on the context of tokens.
+// The cache holds the context processed by the previous calls, so only the new tokens are fed to the model.
+func nextTok(model *Model, cache *Cache, context []float64) float64 {
+	probs := Softmax(nextLogits(model, cache, context))
+	tok := pkg.SampleTemp(probs, 0.8)
+
+	return tok
+}
+
+// Returns the logits of the token following the context, only the tokens not in the cache are fed to the model.
+func nextLogits(model *Model, cache *Cache, context []float64) *variable.Variable {
+	// Positions can't slide along with the context, so once it doesn't fit the model's context,
+	// the cache is refilled with the recent half of it. It's cheaper than refilling every token.
+	if len(context)-cache.Start > model.context {
+		cache.Reset(len(context) - max(1, model.context/2))
+	}
+	// Tokens of the prefix attend to the ones after them, so until the prefix is complete
+	// it's fed again with every new token, the cached tokens haven't seen it.
+	if cache.Len() > 0 && cache.Len() < model.prefix {
+		cache.Reset(cache.Start)
+	}
+
+	// Feed new context tokens to the model, get a list of final logits for the next token.
+	logits := model.ForwardCached(cache, context[cache.Start+cache.Len():]...)
+
+	// We only care about the scores of the next token for the last token.
+	return Rows(logits, -1)
+}
+
+// Loads the last checkpoint after a non-finite loss, the best one holds the averaged weights, so it's
+// used only if there are no others. The moments and the averages are of the diverged weights,
+// they start anew. Returns the file name of the loaded checkpoint.
+func rollback(params *pkg.Params, checkpoints *pkg.Checkpoints, optimizer *pkg.AdamW, ema *pkg.EMA) string {
+	filename := checkpoints.Last()
+	if filename == "" {
+		filename = params.Filename()
+	}
+	params.LoadFrom(filename)
+	optimizer.Reset()
+	ema.Reset()
+
+	return filename
+}
+
+// Returns the prompt continued by the averaged weights, used to watch the training progress.
+func generate(model *Model, ema *pkg.EMA, prompt string) string {
+	defer ema.Apply().End()
+	defer variable.Nograd().End()
+	defer variable.TestMode().End()
+
+	context := data.Encode(prompt)
+	cache := model.NewCache()
+	for range config.MaxTokens {
+		context = append(context, nextTok(model, cache, context))
+	}
+
+	return data.Decode(context...)
+}
+
+// Returns the mean loss of the averaged weights over random samples of the dataset.
+func evaluate(model *Model, ema *pkg.EMA, dataset []float64) float64 {
+	defer ema.Apply().End()
+	defer variable.Nograd().End()   // no need to build the computation graph
+	defer variable.TestMode().End() // disable dropout
+
+	var losses float64
+	for range config.EvalIters {
+		input, targets := data.Sample(dataset, model.blockSize)
+		logits := model.Forward(Flat(input)...)
+		losses += Val(SoftmaxCrossEntropy(model.Scored(logits, targets)))
+	}
+
+	return losses / float64(config.EvalIters)
+}
+
+// Prints the number of params, split into trainable and frozen ones if some are frozen.
+func printSize(name string, params *pkg.Params) {
+	frozen := params.CountFrozen()
+	if frozen == 0 {
+		fmt.Printf("%s size: %.3fM\n", name, pkg.Millions(params.Count()))
+		return
+	}
+
+	trainable := params.Count() - frozen
+	fmt.Printf("%s size: %.3fM, trainable: %.3fM, frozen: %.3fM\n", name, pkg.Millions(params.Count()), pkg.Millions(trainable), pkg.Millions(frozen))
+}
+
+func createFile(name string) *os.File {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return file
+}
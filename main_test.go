@@ -1,11 +1,20 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/matrix"
 	"github.com/itsubaki/autograd/variable"
 	"github.com/zakirullin/gpt-go/data"
+	"github.com/zakirullin/gpt-go/pkg"
 )
 
 func TestNeuron(t *testing.T) {
@@ -290,10 +299,10 @@ func TestWeightedSelfAttention(t *testing.T) {
 	attentionScores = MaskedInfFill(attentionScores, tril)
 	no := math.Inf(-1)
 	areMatricesEqual(t, M{
-		{80, no, no, no},
-		{640, 160, no, no},
-		{80, 20, 80, no},
-		{720, 180, 720, 180}, // token " and" is interested in "cat" and "dog", not so much in the others
+		{40, no, no, no},
+		{320, 80, no, no},
+		{40, 10, 40, no},
+		{360, 90, 360, 90}, // token " and" is interested in "cat" and "dog", not so much in the others
 	}, attentionScores)
 
 	attentionScores = Softmax(attentionScores) // fancy trick to turn {1, 1, no, no} to {0.5, 0.5, 0, 0}
@@ -355,6 +364,954 @@ func TestTransformer(t *testing.T) {
 	areEqual(t, 2.302585092994046, loss)
 }
 
+func TestLayerNorm(t *testing.T) {
+	ln := NewLayerNorm(4)
+	ln.Scale, ln.Shift = pkg.Normal(1, 4), pkg.Normal(1, 4)
+	x := pkg.Normal(3, 4)
+
+	// Fused function computes the same as the primitives.
+	xhat := Div(Sub(x, Mean(x)), Pow(0.5)(Add(Variance(x), variable.New(ln.eps))))
+	want := Add(Mul(ln.Scale, xhat), ln.Shift)
+	want.Backward()
+	wantGrads := []*variable.Variable{x.Grad, ln.Scale.Grad, ln.Shift.Grad}
+
+	for _, v := range []*variable.Variable{x, ln.Scale, ln.Shift} {
+		v.Cleargrad()
+	}
+	got := ln.Forward(x)
+	got.Backward()
+
+	areMatricesEqualTol(t, want.Data, got.Data)
+	for i, v := range []*variable.Variable{x, ln.Scale, ln.Shift} {
+		areMatricesEqualTol(t, wantGrads[i].Data, v.Grad.Data)
+	}
+}
+
+func TestModel(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2})
+
+	// Context can be shorter than the block size during generation.
+	logits := model.Forward(1, 2, 3)
+	if logits.Data.Rows != 3 || logits.Data.Cols != 10 {
+		t.Errorf("want 3×10 logits, got %d×%d", logits.Data.Rows, logits.Data.Cols)
+	}
+
+	// Gradients must reach every parameter.
+	loss := SoftmaxCrossEntropy(logits, V{2, 3, 4}.Var())
+	loss.Backward()
+	for i, param := range model.Params() {
+		if param.Grad == nil {
+			t.Errorf("param %d has no gradient", i)
+		}
+	}
+}
+
+func TestBlockGradCheck(t *testing.T) {
+	RandWeights = pkg.Normal
+	// ReLU is left out, the numerical gradient is off whenever a value is close to its kink.
+	for name, opts := range map[string][]BlockOption{
+		"gelu":      {WithActivation(GELU)},
+		"gelu_tanh": {WithActivation(GELUTanh), WithHiddenRatio(2)},
+		"silu":      {WithActivation(SiLU)},
+		"swiglu":    {WithSwiGLU(), WithHiddenRatio(8.0 / 3)},
+	} {
+		block := NewBlock(4, 2, opts...)
+		input := pkg.Normal(3, 4)
+
+		// Params are used by the block, gradcheck perturbs them in place.
+		forward := func(x ...*variable.Variable) *variable.Variable {
+			return block.Forward(x[0])
+		}
+		if err := pkg.GradCheck(forward, append([]*variable.Variable{input}, block.Params()...)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// SwiGLU has a gate projection, 8/3 of 6 embeds is 16 hidden neurons.
+	block := NewBlock(6, 2, WithSwiGLU(), WithHiddenRatio(8.0/3))
+	if len(block.Params()) != len(NewBlock(6, 2).Params())+2 || block.mlpGate.Weight.Data.Cols != 16 {
+		t.Errorf("want gate of 16 hidden neurons")
+	}
+}
+
+func TestModelGradCheck(t *testing.T) {
+	RandWeights, RandEmbeds = pkg.Normal, pkg.Normal
+	model := NewModel(5, ModelConfig{BlockSize: 3, EmbedSize: 4, Heads: 2, Layers: 2, Activation: "gelu"}) // no ReLU kinks for gradcheck
+
+	loss := func(_ ...*variable.Variable) *variable.Variable {
+		return SoftmaxCrossEntropy(model.Forward(0, 3, 1), V{3, 1, 4}.Var())
+	}
+	if err := pkg.GradCheck(loss, model.Params()...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDataParallel(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1})
+	input, targets := V{1, 2, 3, 4}, V{2, 3, 4, 5}
+
+	// Gradients of a single model.
+	loss := SoftmaxCrossEntropy(model.Forward(input...), targets.Var())
+	loss.Backward()
+	var want []*variable.Variable
+	for _, param := range model.Params() {
+		want = append(want, param.Grad)
+		param.Cleargrad()
+	}
+
+	// Replicas see the same sample, so the averaged gradients must match.
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	var replicas []*Model
+	var replicaParams []*pkg.Params
+	for range 3 {
+		replica := model.Replica()
+		rparams := pkg.NewParams()
+		rparams.Add(replica.Params()...)
+		replicas = append(replicas, replica)
+		replicaParams = append(replicaParams, rparams)
+	}
+	got := pkg.NewDataParallel(params, replicaParams...).Step(func(r int) *variable.Variable {
+		return SoftmaxCrossEntropy(replicas[r].Forward(input...), targets.Var())
+	})
+
+	areEqual(t, got, loss)
+	for i, param := range model.Params() {
+		for j, g := range Flat(want[i]) {
+			if math.Abs(g-Flat(param.Grad)[j]) > 1e-9 {
+				t.Fatalf("param %d gradient mismatch: want %v, got %v", i, g, Flat(param.Grad)[j])
+			}
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1})
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	optimizer := pkg.NewAdamW(0.01)
+	ema := pkg.NewEMA(params, 0.9)
+	checkpoints := pkg.NewCheckpoints(params, 2)
+	step := func(optimizer *pkg.AdamW) {
+		SoftmaxCrossEntropy(model.Forward(1, 2, 3), V{2, 3, 4}.Var()).Backward()
+		optimizer.Update(params)
+		ema.Update()
+		params.ZeroGrad()
+	}
+	snapshot := func() []*matrix.Matrix {
+		var data []*matrix.Matrix
+		for _, param := range params.ByName() {
+			data = append(data, matrix.F(param.Data, func(v float64) float64 { return v }))
+		}
+		return data
+	}
+	areParamsEqual := func(want []*matrix.Matrix) {
+		got := snapshot()
+		for i := range want {
+			areMatricesEqualTol(t, want[i], got[i])
+		}
+	}
+
+	// Without raw checkpoints the training rolls back to the best one.
+	step(&optimizer)
+	span := ema.Apply()
+	params.Save()
+	best := snapshot()
+	span.End()
+	if got := rollback(params, checkpoints, &optimizer, ema); got != params.Filename() {
+		t.Errorf("want rollback to %s, got %s", params.Filename(), got)
+	}
+	areParamsEqual(best)
+
+	// The last raw checkpoint is preferred to the averaged weights of the best one.
+	step(&optimizer)
+	checkpoints.Save(2)
+	saved := snapshot()
+	step(&optimizer)
+	for _, param := range params.Params() {
+		param.Data = matrix.F(param.Data, func(float64) float64 { return math.NaN() })
+	}
+	if got := rollback(params, checkpoints, &optimizer, ema); got != checkpoints.Last() {
+		t.Errorf("want rollback to %s, got %s", checkpoints.Last(), got)
+	}
+	areParamsEqual(saved)
+
+	// Averages start from the loaded weights, the next step is the one of a fresh optimizer.
+	span = ema.Apply()
+	areParamsEqual(saved)
+	span.End()
+	step(&optimizer)
+	want := snapshot()
+	params.LoadFrom(checkpoints.Last())
+	fresh := pkg.NewAdamW(0.01)
+	step(&fresh)
+	areParamsEqual(want)
+}
+
+func TestModelAnomalies(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2})
+	loss := SoftmaxCrossEntropy(model.Forward(1, 2, 3, 4), V{2, 3, 4, 5}.Var())
+	loss.Backward(variable.Opts{RetainGrad: true})
+
+	// Masked attention is full of infinities, they must not be reported.
+	if err := pkg.CheckForward(loss); err != nil {
+		t.Error(err)
+	}
+	if err := pkg.CheckBackward(loss); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCrossEntropy(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1})
+	tokens := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1}
+
+	// Non-overlapping windows are scored as usual.
+	var want float64
+	for _, begin := range []int{0, 4} {
+		logits := model.Forward(tokens[begin : begin+4]...)
+		want += 4 * Val(SoftmaxCrossEntropy(logits, variable.New(tokens[begin+1:begin+5]...)))
+	}
+	logits := model.Forward(tokens[8:10]...)
+	want += 2 * Val(SoftmaxCrossEntropy(logits, variable.New(tokens[9:11]...)))
+
+	nll, scored := crossEntropy(model, tokens, 4)
+	if scored != 10 || math.Abs(nll-want) > 1e-9 {
+		t.Errorf("want nll=%v for 10 tokens, got nll=%v for %d tokens", want, nll, scored)
+	}
+
+	// Every token is scored exactly once regardless of the stride.
+	for _, stride := range []int{1, 3, 100} {
+		if _, scored := crossEntropy(model, tokens, stride); scored != 10 {
+			t.Errorf("stride=%d: want 10 scored tokens, got %d", stride, scored)
+		}
+	}
+}
+
+func TestKVCache(t *testing.T) {
+	for _, config := range []ModelConfig{
+		{BlockSize: 6, EmbedSize: 8, Heads: 2, Layers: 2},
+		{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Positions: RoPEPositions, MaxContext: 6},
+		{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Positions: ALiBiPositions, MaxContext: 6},
+		{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Positions: SinusoidalPositions, MaxContext: 6},
+		{BlockSize: 6, EmbedSize: 8, Heads: 4, Layers: 2, KVHeads: 2, Positions: RoPEPositions},
+		{BlockSize: 6, EmbedSize: 8, Heads: 2, Layers: 2, KVHeads: 1},
+		{BlockSize: 6, EmbedSize: 8, Heads: 2, Layers: 2, Mask: "sliding:2", Positions: ALiBiPositions},
+		{BlockSize: 6, EmbedSize: 8, Heads: 2, Layers: 2, Mask: "dilated:2:2"},
+		{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Positions: ALiBiPositions, MaxContext: 6, FlashAttention: true},
+		{BlockSize: 6, EmbedSize: 8, Heads: 2, Layers: 2, Experts: 4},
+	} {
+		model := NewModel(10, config)
+		tokens := []float64{1, 2, 3, 4, 5, 6}
+		want := model.Forward(tokens...)
+
+		// The prompt is processed at once, then the tokens are fed one by one.
+		cache := model.NewCache()
+		got := []*variable.Variable{model.ForwardCached(cache, tokens[:3]...)}
+		for _, token := range tokens[3:] {
+			got = append(got, model.ForwardCached(cache, token))
+		}
+		if cache.Len() != len(tokens) {
+			t.Errorf("%s: want %d cached tokens, got %d", config.Positions, len(tokens), cache.Len())
+		}
+
+		row := 0
+		for _, logits := range got {
+			for i := range logits.Data.Rows {
+				for j, v := range logits.Data.Row(i) {
+					if math.Abs(v-want.Data.At(row, j)) > 1e-12 {
+						t.Fatalf("%s, token %d: want logits %v, got %v", config.Positions, row, want.Data.Row(row), logits.Data.Row(i))
+					}
+				}
+				row++
+			}
+		}
+
+		// Generation keeps going once the context doesn't fit.
+		context := []float64{1, 2, 3}
+		cache = model.NewCache()
+		for range 20 {
+			context = append(context, nextTok(model, cache, context))
+		}
+	}
+}
+
+func TestFlashAttention(t *testing.T) {
+	for _, config := range []ModelConfig{
+		{BlockSize: 40, EmbedSize: 8, Heads: 2, Layers: 2}, // longer than a tile
+		{BlockSize: 40, EmbedSize: 8, Heads: 4, Layers: 1, KVHeads: 2, Positions: RoPEPositions},
+		{BlockSize: 12, EmbedSize: 8, Heads: 2, Layers: 1, Positions: ALiBiPositions, Mask: "sliding:5"},
+		{BlockSize: 12, EmbedSize: 8, Heads: 2, Layers: 1, Mask: "prefix:4"},
+	} {
+		model := NewModel(10, config)
+		tokens, targets := make([]float64, config.BlockSize), make([]float64, config.BlockSize)
+		for i := range tokens {
+			tokens[i], targets[i] = float64(i%10), float64((i+1)%10)
+		}
+
+		// Same weights, the attention of every head is computed both ways.
+		forward := func(flash bool) (*variable.Variable, []*variable.Variable) {
+			for _, block := range model.blocks {
+				for _, head := range block.saHead.Heads {
+					head.flash = flash
+				}
+			}
+			logits := model.Forward(tokens...)
+			loss := SoftmaxCrossEntropy(logits, V(targets).Var())
+			loss.Backward()
+
+			var grads []*variable.Variable
+			for _, param := range model.Params() {
+				grads = append(grads, param.Grad)
+				param.Cleargrad()
+			}
+			return logits, grads
+		}
+
+		want, wantGrads := forward(false)
+		got, gotGrads := forward(true)
+		areMatricesEqualTol(t, want.Data, got.Data)
+		for i := range wantGrads {
+			areMatricesEqualTol(t, wantGrads[i].Data, gotGrads[i].Data)
+		}
+	}
+}
+
+func TestDoubledScores(t *testing.T) {
+	// Doubled scores are the scores of doubled queries, with or without flash attention.
+	q, k, v := pkg.Normal(4, 3), pkg.Normal(4, 3), pkg.Normal(4, 3)
+	want := (&Head{embedSize: 6, headSize: 3, mask: CausalMask()}).Forward(MulC(2, q), k, v, 0)
+	for _, flash := range []bool{false, true} {
+		head := &Head{embedSize: 6, headSize: 3, mask: CausalMask(), flash: flash, doubled: true}
+		areMatricesEqualTol(t, want.Data, head.Forward(q, k, v, 0).Data)
+	}
+
+	mh := NewMultiHeadAttention(6, 2, WithDoubledScores())
+	for i, head := range mh.Heads {
+		if !head.doubled {
+			t.Errorf("want doubled scores of head %d", i)
+		}
+	}
+}
+
+func TestRoPE(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1, Positions: RoPEPositions, Activation: "gelu"}) // no ReLU kinks for gradcheck
+	if model.posEmbeds != nil {
+		t.Errorf("want no learned positions")
+	}
+
+	// Trained on 4 tokens, the model takes longer contexts.
+	logits := model.Forward(1, 2, 3, 4, 5, 6, 7, 8)
+	if logits.Data.Rows != 8 {
+		t.Errorf("want 8 rows of logits, got %d", logits.Data.Rows)
+	}
+
+	tokens := []float64{1, 2, 3}
+	targets := variable.New(2, 3, 4)
+	loss := func(_ ...*variable.Variable) *variable.Variable {
+		return SoftmaxCrossEntropy(model.Forward(tokens...), targets)
+	}
+	if err := pkg.GradCheck(loss, model.blocks[0].saHead.Params()...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestALiBi(t *testing.T) {
+	mh := NewMultiHeadAttention(8, 4, WithALiBi())
+	for i, want := range []float64{1.0 / 4, 1.0 / 16, 1.0 / 64, 1.0 / 256} {
+		if mh.Heads[i].slope != want {
+			t.Errorf("head %d: want slope %v, got %v", i, want, mh.Heads[i].slope)
+		}
+	}
+
+	// The second token attends to 3 cached tokens and itself.
+	areMatricesEqual(t, M{
+		{-0.75, -0.5, -0.25, 0, -0.25},
+		{-1, -0.75, -0.5, -0.25, 0},
+	}, alibiBias(2, 3, 0.25))
+}
+
+func TestSinusoidalPositions(t *testing.T) {
+	learned := pkg.NewParams()
+	learned.Add(NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1}).Params()...)
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1, Positions: SinusoidalPositions})
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	if learned.Count()-params.Count() != 4*8 {
+		t.Errorf("want %d params saved, got %d", 4*8, learned.Count()-params.Count())
+	}
+
+	// Trained on 4 tokens, the model takes longer contexts.
+	if logits := model.Forward(1, 2, 3, 4, 5, 6, 7, 8); logits.Data.Rows != 8 {
+		t.Errorf("want 8 rows of logits, got %d", logits.Data.Rows)
+	}
+}
+
+func TestFusedAttention(t *testing.T) {
+	// Reference: every head has its own Query, Key and Value weights.
+	mh := NewMultiHeadAttention(8, 2)
+	var heads []layer.Parameter // query, key, value of the first head, then of the second one
+	for range 3 * 2 {
+		heads = append(heads, pkg.Normal(8, 4))
+	}
+	fuseHeads(mh, heads)
+
+	input := pkg.Normal(3, 8)
+	var features []*variable.Variable
+	for i, head := range mh.Heads {
+		query, key, value := MatMul(input, heads[3*i]), MatMul(input, heads[3*i+1]), MatMul(input, heads[3*i+2])
+		features = append(features, head.Forward(query, key, value, 0))
+	}
+	want := mh.proj.Forward(pkg.Cat(features...))
+	want.Backward()
+	wantGrad := input.Grad
+	input.Cleargrad()
+
+	got := mh.Forward(input)
+	got.Backward()
+	areMatricesEqualTol(t, want.Data, got.Data)
+	areMatricesEqualTol(t, wantGrad.Data, input.Grad.Data)
+
+	// Gradients of the fused weight are the gradients of the per-head weights.
+	for i, weight := range heads {
+		head, kind := i/3, i%3
+		offset := kind*8 + head*4
+		for r := range 8 {
+			for c := range 4 {
+				if math.Abs(weight.Grad.Data.At(r, c)-mh.qkv.Weight.Grad.Data.At(r, offset+c)) > 1e-12 {
+					t.Fatalf("weight %d: gradients differ at %d,%d", i, r, c)
+				}
+			}
+		}
+	}
+}
+
+func TestConvertPerHead(t *testing.T) {
+	config := ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2}
+	model := NewModel(10, config)
+
+	// Save the model in the per-head layout.
+	legacy := pkg.NewParams()
+	for _, param := range model.Params() {
+		mh := attentionOf(model, param)
+		if mh == nil {
+			legacy.Add(param)
+			continue
+		}
+		for head := range 2 {
+			for kind := range 3 { // query, key, value
+				weight := Zeros(8, 4)
+				for r := range 8 {
+					copy(weight.Data.Row(r), param.Data.Row(r)[kind*8+head*4:])
+				}
+				legacy.Add(weight)
+			}
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "model")
+	legacy.SaveAs(filename)
+
+	// Loading it as is points to the conversion.
+	func() {
+		defer func() {
+			if err := fmt.Sprint(recover()); !strings.Contains(err, "go run . convert -in "+filename) {
+				t.Errorf("want the convert command in the error, got %s", err)
+			}
+		}()
+		params := pkg.NewParams()
+		params.Add(NewModel(10, config).Params()...)
+		params.LoadFrom(filename)
+	}()
+
+	converted := NewModel(10, config)
+	loadPerHead(converted, filename)
+	areMatricesEqualTol(t, model.Forward(1, 2, 3).Data, converted.Forward(1, 2, 3).Data)
+}
+
+func attentionOf(model *Model, param layer.Parameter) *MultiHeadAttention {
+	for _, block := range model.blocks {
+		if block.saHead.qkv.Weight == param {
+			return block.saHead
+		}
+	}
+
+	return nil
+}
+
+func areMatricesEqualTol(t *testing.T, want, got *matrix.Matrix) {
+	t.Helper()
+	if want.Rows != got.Rows || want.Cols != got.Cols {
+		t.Fatalf("want %dx%d, got %dx%d", want.Rows, want.Cols, got.Rows, got.Cols)
+	}
+	for i := range want.Data {
+		if math.Abs(want.Data[i]-got.Data[i]) > 1e-12 {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestGroupedQueryAttention(t *testing.T) {
+	count := func(kvHeads int) int {
+		params := pkg.NewParams()
+		params.Add(NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 4, KVHeads: kvHeads, Layers: 2}).Params()...)
+		return params.Count()
+	}
+
+	// Keys and values of 4 heads of size 2 take 2*4*2 columns of the projection of 8 embeds.
+	saved := 2 * 8 * 2 * (4 - 1) // per layer
+	if count(4)-count(1) != 2*saved {
+		t.Errorf("want %d params saved by multi-query attention, got %d", 2*saved, count(4)-count(1))
+	}
+
+	// Query heads of a group attend to the same keys: the ones with the same queries are identical.
+	mh := NewMultiHeadAttention(8, 4, WithKVHeads(2))
+	for r := range 8 {
+		copy(mh.qkv.Weight.Data.Row(r)[2:4], mh.qkv.Weight.Data.Row(r)[0:2]) // query of head 1 = head 0
+		copy(mh.qkv.Weight.Data.Row(r)[6:8], mh.qkv.Weight.Data.Row(r)[0:2]) // query of head 3 = head 0
+	}
+	input := pkg.Normal(3, 8)
+	qkv := pkg.Split(mh.qkv.Forward(input), 4+2*2)
+	head := func(i int) *variable.Variable {
+		return mh.Heads[i].Forward(qkv[i], qkv[4+i/2], qkv[6+i/2], 0)
+	}
+	areMatricesEqualTol(t, head(0).Data, head(1).Data)
+	if math.Abs(head(0).Data.At(2, 0)-head(3).Data.At(2, 0)) < 1e-12 {
+		t.Errorf("want heads of different groups to differ")
+	}
+}
+
+func TestRMSNorm(t *testing.T) {
+	config := ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Activation: "gelu"} // no ReLU kinks for gradcheck
+	layerNorm := NewModel(10, config)
+	config.Norm = "rmsnorm"
+	model := NewModel(10, config)
+
+	// Every norm saves its shift: 2 per block and the final one.
+	if len(layerNorm.Params())-len(model.Params()) != 2*2+1 {
+		t.Errorf("want no shifts in the model with RMSNorm")
+	}
+
+	tokens := []float64{1, 2, 3}
+	loss := func(_ ...*variable.Variable) *variable.Variable {
+		return SoftmaxCrossEntropy(model.Forward(tokens...), variable.New(2, 3, 4))
+	}
+	if err := pkg.GradCheck(loss, model.blocks[1].Params()...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResidual(t *testing.T) {
+	input := M{
+		{1, 2, 3, 4},
+		{-4, 0, 2, 10},
+	}.Var()
+	norm := NewLayerNorm(4)
+	normalized := norm.Forward(norm.Forward(input)) // by both norms of the block
+
+	// Blocks adding nothing to the residual stream.
+	block := func(residual string) *Block {
+		b := NewBlock(4, 2, WithResidual(residual))
+		b.saHead.proj.Weight = Zeros(4, 4)
+		b.mlpProj.Weight = Zeros(16, 4)
+		return b
+	}
+
+	// Pre-norm carries the raw input, the others normalize it.
+	areMatricesEqualTol(t, input.Data, block(PreNorm).Forward(input).Data)
+	areMatricesEqualTol(t, normalized.Data, block(PostNorm).Forward(input).Data)
+	areMatricesEqualTol(t, normalized.Data, block(LegacyNorm).Forward(input).Data)
+
+	// Legacy blocks double the attention scores, as the models trained before the masking was fixed.
+	for _, residual := range []string{PreNorm, PostNorm, LegacyNorm} {
+		if got, want := NewBlock(4, 2, WithResidual(residual)).saHead.Heads[0].doubled, residual == LegacyNorm; got != want {
+			t.Errorf("%s: want doubled scores %v, got %v", residual, want, got)
+		}
+	}
+
+	for _, residual := range []string{PreNorm, PostNorm, LegacyNorm} {
+		b := NewBlock(4, 2, WithResidual(residual), WithActivation(GELU)) // no ReLU kinks for gradcheck
+		forward := func(x ...*variable.Variable) *variable.Variable {
+			return b.Forward(x[0])
+		}
+		if err := pkg.GradCheck(forward, append([]*variable.Variable{pkg.Normal(3, 4)}, b.Params()...)...); err != nil {
+			t.Errorf("%s: %v", residual, err)
+		}
+	}
+}
+
+func TestTiedEmbeddings(t *testing.T) {
+	config := ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1, Activation: "gelu"} // no ReLU kinks for gradcheck
+	untied := pkg.NewParams()
+	untied.Add(NewModel(10, config).Params()...)
+	config.TieEmbeddings = true
+	model := NewModel(10, config)
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+
+	// The lmHead weight and bias are not stored.
+	if untied.Count()-params.Count() != 8*10+10 {
+		t.Errorf("want %d params saved, got %d", 8*10+10, untied.Count()-params.Count())
+	}
+
+	// Embeds get the gradients of the input and of the output.
+	tokens := []float64{1, 2, 3}
+	loss := func(_ ...*variable.Variable) *variable.Variable {
+		return SoftmaxCrossEntropy(model.Forward(tokens...), variable.New(2, 3, 4))
+	}
+	if err := pkg.GradCheck(loss, model.tokEmbeds); err != nil {
+		t.Error(err)
+	}
+	if model.tokEmbeds.Grad.Data.At(9, 0) == 0 {
+		t.Errorf("want the gradient of the output for the tokens missing in the input")
+	}
+}
+
+func TestMoE(t *testing.T) {
+	// A single expert gets every token with probability 1, it's the MLP.
+	input := pkg.Normal(5, 8)
+	moe := NewMoE(8, 16, 1, 1, 0, ReLU, false, 0)
+	areMatricesEqualTol(t, moe.experts[0].Forward(input).Data, moe.Forward(input).Data)
+
+	// Every token prefers the first expert, the capacity of 1.0 is an even share of 8 tokens: 2 tokens.
+	// Tokens are counted by non-zero outputs, ReLU could zero all of them.
+	moe = NewMoE(2, 8, 4, 1, 1.0, GELU, false, 0)
+	moe.router.Weight = M{{10, 0, 0, 0}, {10, 0, 0, 0}}.Var()
+	input = pkg.Ones(8, 2)
+	processed := func(out *variable.Variable) int {
+		var count int
+		for i := range out.Data.Rows {
+			if out.Data.At(i, 0) != 0 || out.Data.At(i, 1) != 0 {
+				count++
+			}
+		}
+		return count
+	}
+	if got := processed(moe.Forward(input)); got != 2 {
+		t.Errorf("want 2 tokens processed within the capacity, got %d", got)
+	}
+	span := variable.TestMode()
+	if got := processed(moe.Forward(input)); got != 8 {
+		t.Errorf("want every token processed without training, got %d", got)
+	}
+	span.End()
+
+	// Load balancing loss of a single preferred expert is numExperts times the one of even routing.
+	moe.Forward(input)
+	areEqual(t, 4*0.01, moe.AuxLoss())
+	moe.router.Weight = Zeros(2, 4)
+	moe.Forward(M{{1, 0}, {0, 1}, {1, 1}, {0, 0}}.Var())
+	areEqual(t, 0.01, moe.AuxLoss())
+
+	// Gradients flow to the router, through the gates and the load balancing loss, and to the experts.
+	moe = NewMoE(4, 8, 3, 2, 0, GELU, true, 0)
+	input = pkg.Normal(6, 4)
+	loss := func(_ ...*variable.Variable) *variable.Variable {
+		return Add(variable.Sum(moe.Forward(input)), moe.AuxLoss())
+	}
+	if err := pkg.GradCheck(loss, append([]*variable.Variable{input}, moe.Params()...)...); err != nil {
+		t.Error(err)
+	}
+
+	// Experts multiply the MLP params, the training loss includes the load balancing loss.
+	count := func(experts int) int {
+		params := pkg.NewParams()
+		params.Add(NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Experts: experts}).Params()...)
+		return params.Count()
+	}
+	mlp := 8*32 + 32 + 32*8 + 8
+	if got := count(4) - count(0); got != 2*(3*mlp+8*4) {
+		t.Errorf("want %d more params, got %d", 2*(3*mlp+8*4), got)
+	}
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Experts: 4, ExpertsPerToken: 1})
+	if model.AuxLoss() != nil {
+		t.Errorf("want no load balancing loss before forward")
+	}
+	model.Forward(1, 2, 3, 4)
+	if aux := model.AuxLoss(); aux == nil || Val(aux) <= 0 {
+		t.Errorf("want load balancing loss, got %v", aux)
+	}
+}
+
+func TestLoRA(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2, Activation: "gelu"}) // no ReLU kinks for gradcheck
+	tokens := []float64{1, 2, 3, 4}
+	base := model.Forward(tokens...)
+
+	// Targets match the last part of the name or are globs of the full name.
+	model.AddLoRA(2, 4, "qkv", "blocks.1.mlp*")
+	var adapted []string
+	for _, linear := range model.Linears() {
+		if linear.lora != nil {
+			adapted = append(adapted, linear.Name)
+		}
+	}
+	want := []string{"blocks.0.attention.qkv", "blocks.1.attention.qkv", "blocks.1.mlp", "blocks.1.mlp_proj"}
+	if !reflect.DeepEqual(want, adapted) {
+		t.Errorf("want adapters of %v, got %v", want, adapted)
+	}
+
+	// New adapters don't change the output, only they are trained.
+	areMatricesEqualTol(t, base.Data, model.Forward(tokens...).Data)
+	params := newLoRAParams(model)
+	if got, want := params.Count(), 2*(8*2+2*24)+(8*2+2*32)+(32*2+2*8); got != want {
+		t.Errorf("want %d adapter params, got %d", want, got)
+	}
+	if len(model.Trainable()) != len(model.LoRAParams()) {
+		t.Errorf("want only the adapters trainable")
+	}
+
+	for _, param := range model.LoRAParams() {
+		param.Data = pkg.Normal(param.Data.Rows, param.Data.Cols).Data
+	}
+	loss := func(_ ...*variable.Variable) *variable.Variable {
+		return SoftmaxCrossEntropy(model.Forward(tokens...), V{2, 3, 4, 5}.Var())
+	}
+	if err := pkg.GradCheck(loss, model.LoRAParams()...); err != nil {
+		t.Error(err)
+	}
+
+	// Adapters are saved to their own file and loaded into a model with the same base weights.
+	filename := filepath.Join(t.TempDir(), "lora")
+	params.SaveAs(filename)
+	fineTuned := model.Forward(tokens...)
+	loaded := model.Replica()
+	for _, param := range loaded.LoRAParams() {
+		param.Data = Zeros(param.Data.Rows, param.Data.Cols).Data
+	}
+	newLoRAParams(loaded).LoadFrom(filename)
+	areMatricesEqualTol(t, fineTuned.Data, loaded.Forward(tokens...).Data)
+
+	// Merged weights compute the same without the adapters.
+	model.MergeLoRA()
+	if len(model.LoRAParams()) != 0 || len(model.Trainable()) != len(model.Params()) {
+		t.Errorf("want no adapters after merge")
+	}
+	areMatricesEqualTol(t, fineTuned.Data, model.Forward(tokens...).Data)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("want panic for a target matching no layers")
+		}
+	}()
+	model.AddLoRA(2, 4, "attention")
+}
+
+func TestFreeze(t *testing.T) {
+	// Every param has a unique name.
+	for _, config := range []ModelConfig{
+		{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2},
+		{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 1, Experts: 2, Activation: "swiglu", Norm: "rmsnorm", TieEmbeddings: true},
+	} {
+		model := NewModel(10, config)
+		names := model.ParamNames()
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if name == "" || seen[name] {
+				t.Errorf("want unique names, got %v", names)
+			}
+			seen[name] = true
+		}
+		if len(names) != len(model.Params()) {
+			t.Errorf("want %d names, got %d", len(model.Params()), len(names))
+		}
+	}
+
+	model := NewModel(10, ModelConfig{BlockSize: 4, EmbedSize: 8, Heads: 2, Layers: 2})
+	params := pkg.NewParams()
+	params.Add(model.Params()...)
+	params.SetNames(model.ParamNames()...)
+	params.Freeze("*_embeds", "blocks.0")
+	block := (params.Count() - 10*8 - 4*8 - 2*8 - (8*10 + 10)) / 2 // without embeds, norm and lmHead
+	if got, want := params.CountFrozen(), 10*8+4*8+block; got != want {
+		t.Errorf("want %d frozen values, got %d", want, got)
+	}
+
+	// Replicas compute the gradients of frozen params too, but the master params don't get them,
+	// so the frozen weights keep their values.
+	replica := model.Replica()
+	rparams := pkg.NewParams()
+	rparams.Add(replica.Params()...)
+	before := make(map[string]*matrix.Matrix)
+	for _, linear := range model.Linears() {
+		before[linear.Name] = linear.Weight.Data
+	}
+	pkg.NewDataParallel(params, rparams).Step(func(_ int) *variable.Variable {
+		return SoftmaxCrossEntropy(replica.Forward(1, 2, 3, 4), V{2, 3, 4, 5}.Var())
+	})
+	if grad := model.blocks[0].saHead.qkv.Weight.Grad; grad != nil {
+		t.Errorf("want no gradient of a frozen weight, got %v", grad)
+	}
+	optimizer := pkg.NewAdamW(0.01)
+	optimizer.Update(params)
+	for _, linear := range model.Linears() {
+		frozen := linear.Weight.Data == before[linear.Name]
+		if want := params.IsFrozen(linear.Weight); frozen != want {
+			t.Errorf("%s: want frozen %v, got %v", linear.Name, want, frozen)
+		}
+	}
+	if !params.IsFrozen(model.tokEmbeds) || params.IsFrozen(model.blocks[1].mlp.Weight) {
+		t.Errorf("want embeds and the first block frozen only")
+	}
+}
+
+func TestAttentionMasks(t *testing.T) {
+	render := func(mask AttentionMask) M {
+		var m M
+		for query := range 5 {
+			var row []float64
+			for key := range 5 {
+				if mask(query, key) {
+					row = append(row, 1)
+				} else {
+					row = append(row, 0)
+				}
+			}
+			m = append(m, row)
+		}
+		return m
+	}
+
+	areMatricesEqual(t, M{
+		{1, 0, 0, 0, 0},
+		{1, 1, 0, 0, 0},
+		{1, 1, 1, 0, 0},
+		{1, 1, 1, 1, 0},
+		{1, 1, 1, 1, 1},
+	}, render(ParseMask("causal")).Var())
+	areMatricesEqual(t, M{
+		{1, 0, 0, 0, 0},
+		{1, 1, 0, 0, 0},
+		{0, 1, 1, 0, 0},
+		{0, 0, 1, 1, 0},
+		{0, 0, 0, 1, 1},
+	}, render(ParseMask("sliding:2")).Var())
+	areMatricesEqual(t, M{
+		{1, 0, 0, 0, 0},
+		{0, 1, 0, 0, 0},
+		{1, 0, 1, 0, 0},
+		{0, 1, 0, 1, 0},
+		{0, 0, 1, 0, 1},
+	}, render(ParseMask("dilated:2:2")).Var())
+	areMatricesEqual(t, M{
+		{1, 1, 1, 0, 0},
+		{1, 1, 1, 0, 0},
+		{1, 1, 1, 0, 0},
+		{1, 1, 1, 1, 0},
+		{1, 1, 1, 1, 1},
+	}, render(ParseMask("prefix:3")).Var())
+
+	// Prefix tokens see the later prefix tokens, but not the tokens after the prefix.
+	model := NewModel(10, ModelConfig{BlockSize: 5, EmbedSize: 8, Heads: 2, Layers: 1, Mask: "prefix:3"})
+	logits := model.Forward(1, 2, 3, 4, 5)
+	changedPrefix := model.Forward(1, 2, 6, 4, 5)
+	changedSuffix := model.Forward(1, 2, 3, 7, 5)
+	if logits.Data.At(0, 0) == changedPrefix.Data.At(0, 0) {
+		t.Errorf("want the first token to see the last prefix token")
+	}
+	if logits.Data.At(2, 0) != changedSuffix.Data.At(2, 0) {
+		t.Errorf("want prefix tokens not to see the tokens after the prefix")
+	}
+}
+
+func TestPrefixLM(t *testing.T) {
+	model := NewModel(10, ModelConfig{BlockSize: 5, EmbedSize: 8, Heads: 2, Layers: 2, Mask: "prefix:3"})
+	logits := model.Forward(1, 2, 3, 4, 5)
+
+	// The first two tokens see their targets, only the last prefix token and the ones after it are scored.
+	want := Val(SoftmaxCrossEntropy(Rows(logits, 2, 3, 4), variable.New(4, 5, 6)))
+	for _, targets := range []*variable.Variable{variable.New(2, 3, 4, 5, 6), variable.New(9, 9, 4, 5, 6)} {
+		loss := SoftmaxCrossEntropy(model.Scored(logits, targets))
+		if math.Abs(Val(loss)-want) > 1e-12 {
+			t.Errorf("want loss %v, got %v", want, Val(loss))
+		}
+	}
+	loss := SoftmaxCrossEntropy(model.Scored(logits, variable.New(2, 3, 4, 5, 6)))
+	loss.Backward(variable.Opts{RetainGrad: true})
+	for i := range logits.Data.Rows {
+		var sumSquares float64
+		for _, grad := range logits.Grad.Data.Row(i) {
+			sumSquares += grad * grad
+		}
+		if (sumSquares == 0) != (i < 2) {
+			t.Errorf("want gradients of the scored positions only, position %d has %v", i, logits.Grad.Data.Row(i))
+		}
+	}
+
+	// Eval leaves out the first 3 tokens, every window scores the tokens after its prefix.
+	tokens := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1}
+	for _, stride := range []int{1, 3, 100} {
+		if _, scored := crossEntropy(model, tokens, stride); scored != 8 {
+			t.Errorf("stride=%d: want 8 scored tokens, got %d", stride, scored)
+		}
+	}
+
+	// A prompt shorter than the prefix is fed again until the prefix is complete, then the cache is used.
+	defer variable.Nograd().End()
+	context := []float64{1}
+	cache := model.NewCache()
+	for _, token := range []float64{2, 3, 4, 5} {
+		areMatricesEqualTol(t, Rows(model.Forward(context...), -1).Data, nextLogits(model, cache, context).Data)
+		context = append(context, token)
+	}
+}
+
+func TestSweepGrid(t *testing.T) {
+	spec := SweepSpec{Params: map[string]json.RawMessage{
+		"heads":         json.RawMessage(`[2, 4]`),
+		"learning_rate": json.RawMessage(`[0.001, 0.0001, 0.00001]`),
+	}}
+
+	configs := spec.configs()
+	if len(configs) != 6 {
+		t.Fatalf("want 6 configs, got %d", len(configs))
+	}
+	// The last key changes the fastest.
+	if configs[1]["heads"] != 2.0 || configs[1]["learning_rate"] != 0.0001 || configs[3]["heads"] != 4.0 {
+		t.Errorf("unexpected order of configs: %v", configs)
+	}
+}
+
+func TestSweepRandom(t *testing.T) {
+	spec := SweepSpec{Method: "random", Runs: 20, Params: map[string]json.RawMessage{
+		"layers":        json.RawMessage(`{"min": 1, "max": 3}`),
+		"learning_rate": json.RawMessage(`{"min": 0.0001, "max": 0.01, "log": true}`),
+		"dropout":       json.RawMessage(`[0, 0.1]`),
+	}}
+
+	for _, params := range spec.configs() {
+		config := applyParams(config, params)
+		if config.Layers < 1 || config.Layers > 3 {
+			t.Errorf("layers out of range: %d", config.Layers)
+		}
+		if config.LearningRate < 0.0001 || config.LearningRate > 0.01 {
+			t.Errorf("learning rate out of range: %v", config.LearningRate)
+		}
+		if config.Dropout != 0 && config.Dropout != 0.1 {
+			t.Errorf("dropout not from the list: %v", config.Dropout)
+		}
+	}
+}
+
+func TestApplyParams(t *testing.T) {
+	base := Config{ModelConfig: ModelConfig{EmbedSize: 88, Heads: 4}, Steps: 100}
+	got := applyParams(base, map[string]any{"embed_size": 64.0, "learning_rate": 0.01})
+	want := Config{ModelConfig: ModelConfig{EmbedSize: 64, Heads: 4}, Steps: 100, LearningRate: 0.01}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("want panic for unknown field")
+		}
+	}()
+	applyParams(base, map[string]any{"embed": 64.0})
+}
+
 func areEqual(t *testing.T, want float64, got *variable.Variable) {
 	t.Helper()
 	if got.Data.Rows != 1 {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AttentionMask reports whether the token at position query attends to the token at position key.
+type AttentionMask func(query, key int) bool
+
+// CausalMask lets every token attend to itself and to the tokens before it.
+func CausalMask() AttentionMask {
+	return func(query, key int) bool {
+		return key <= query
+	}
+}
+
+// SlidingWindowMask lets every token attend to itself and to window-1 tokens before it,
+// information from further tokens still comes through the previous layers.
+func SlidingWindowMask(window int) AttentionMask {
+	return func(query, key int) bool {
+		return key <= query && query-key < window
+	}
+}
+
+// DilatedMask is SlidingWindowMask skipping tokens: every token attends to window tokens
+// at the distances 0, dilation, 2*dilation, ..., so the window covers window*dilation tokens.
+func DilatedMask(window, dilation int) AttentionMask {
+	return func(query, key int) bool {
+		distance := query - key
+		return distance >= 0 && distance%dilation == 0 && distance/dilation < window
+	}
+}
+
+// PrefixLMMask lets the first prefix tokens (e.g. a prompt) attend to each other in both directions,
+// the tokens after them are causal. The prefix must be processed at once, its tokens see the ones after them.
+func PrefixLMMask(prefix int) AttentionMask {
+	return func(query, key int) bool {
+		return key <= query || key < prefix
+	}
+}
+
+// MaskPrefix returns P of the prefix:P mask described by spec, 0 for the other masks, see ParseMask.
+func MaskPrefix(spec string) int {
+	name, arg, _ := strings.Cut(spec, ":")
+	if name != "prefix" {
+		return 0
+	}
+	prefix, _ := strconv.Atoi(arg) // validated by ParseMask
+
+	return prefix
+}
+
+// ParseMask returns the mask described by spec: causal, sliding:W, dilated:W:D or prefix:P.
+func ParseMask(spec string) AttentionMask {
+	name, args, _ := strings.Cut(spec, ":")
+	var nums []int
+	if args != "" {
+		for _, arg := range strings.Split(args, ":") {
+			num, err := strconv.Atoi(arg)
+			if err != nil || num < 1 {
+				panic(fmt.Sprintf("invalid mask '%s', arguments must be positive integers", spec))
+			}
+			nums = append(nums, num)
+		}
+	}
+
+	switch {
+	case (name == "causal" || name == "") && len(nums) == 0:
+		return CausalMask()
+	case name == "sliding" && len(nums) == 1:
+		return SlidingWindowMask(nums[0])
+	case name == "dilated" && len(nums) == 2:
+		return DilatedMask(nums[0], nums[1])
+	case name == "prefix" && len(nums) == 1:
+		return PrefixLMMask(nums[0])
+	default:
+		panic(fmt.Sprintf("invalid mask '%s', want causal, sliding:W, dilated:W:D or prefix:P", spec))
+	}
+}
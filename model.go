@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/variable"
+)
+
+// Model is a decoder-only transformer: embeds -> blocks -> norm -> lmHead.
+type Model struct {
+	config    ModelConfig
+	vocabSize int
+	blockSize int // number of tokens the model is trained on
+	context   int // number of tokens the model sees during generation and eval
+	tokEmbeds *variable.Variable
+	posEmbeds *variable.Variable // nil unless positions are learned
+	sinusoids bool               // add fixed sinusoidal position encodings
+	blocks    []*Block
+	norm      Norm
+	lmHead    *Linear     // nil if tied to tokEmbeds
+	lora      *loraConfig // nil unless adapters are attached, see AddLoRA
+	prefix    int         // tokens attending to the ones after them, see PrefixLMMask and Scored
+}
+
+func NewModel(vocabSize int, config ModelConfig) *Model {
+	m := &Model{
+		config:    config,
+		vocabSize: vocabSize,
+		blockSize: config.BlockSize,
+		context:   config.BlockSize,
+		prefix:    MaskPrefix(config.Mask),
+		tokEmbeds: RandEmbeds(vocabSize, config.EmbedSize),
+		norm:      NewLayerNorm(config.EmbedSize),
+		lmHead:    NewLinear(config.EmbedSize, vocabSize),
+	}
+	if config.MaxContext > 0 {
+		m.context = config.MaxContext
+	}
+	if config.TieEmbeddings {
+		m.lmHead = nil
+	}
+
+	attention := []AttentionOption{WithKVHeads(config.Heads), WithMask(ParseMask(config.Mask))}
+	if config.KVHeads > 0 {
+		attention[0] = WithKVHeads(config.KVHeads)
+	}
+	if config.FlashAttention {
+		attention = append(attention, WithFlashAttention())
+	}
+	switch config.Positions {
+	case LearnedPositions, "":
+		m.posEmbeds = RandEmbeds(config.BlockSize, config.EmbedSize)
+		m.context = min(m.context, config.BlockSize) // there are no embeds for further positions
+	case SinusoidalPositions:
+		m.sinusoids = true
+	case RoPEPositions:
+		attention = append(attention, WithRoPE())
+	case ALiBiPositions:
+		attention = append(attention, WithALiBi())
+	default:
+		panic(fmt.Sprintf("unknown positions '%s'", config.Positions))
+	}
+
+	opts := []BlockOption{WithDropout(config.Dropout), WithAttention(attention...)}
+	switch config.Activation {
+	case "relu", "":
+	case "gelu":
+		opts = append(opts, WithActivation(GELU))
+	case "gelu_tanh":
+		opts = append(opts, WithActivation(GELUTanh))
+	case "silu":
+		opts = append(opts, WithActivation(SiLU))
+	case "swiglu":
+		opts = append(opts, WithSwiGLU())
+	default:
+		panic(fmt.Sprintf("unknown activation '%s'", config.Activation))
+	}
+	switch config.Norm {
+	case "layernorm", "":
+	case "rmsnorm":
+		m.norm = NewRMSNorm(config.EmbedSize)
+		opts = append(opts, WithRMSNorm())
+	default:
+		panic(fmt.Sprintf("unknown norm '%s'", config.Norm))
+	}
+	if config.Residual != "" {
+		opts = append(opts, WithResidual(config.Residual))
+	}
+	if config.HiddenRatio > 0 {
+		opts = append(opts, WithHiddenRatio(config.HiddenRatio))
+	}
+	if config.Experts > 0 {
+		topK := config.ExpertsPerToken
+		if topK == 0 {
+			topK = min(2, config.Experts)
+		}
+		opts = append(opts, WithMoE(config.Experts, topK, config.CapacityFactor))
+	}
+
+	for range config.Layers {
+		m.blocks = append(m.blocks, NewBlock(config.EmbedSize, config.Heads, opts...))
+	}
+
+	return m
+}
+
+// Replica returns a model sharing the weights with m, but accumulating its own gradients,
+// so replicas can be trained in parallel, see pkg.DataParallel.
+func (m *Model) Replica() *Model {
+	replica := NewModel(m.vocabSize, m.config)
+	params := m.Params()
+	for i, param := range replica.Params() {
+		param.Data = params[i].Data
+	}
+	if m.lora != nil {
+		replica.AddLoRA(m.lora.rank, m.lora.alpha, m.lora.targets...)
+		adapters := m.LoRAParams()
+		for i, param := range replica.LoRAParams() {
+			param.Data = adapters[i].Data
+		}
+	}
+
+	return replica
+}
+
+// Forward returns the scores of the next token for every input token, (len(tokens), vocabSize).
+func (m *Model) Forward(tokens ...float64) *variable.Variable {
+	return m.ForwardCached(nil, tokens...)
+}
+
+// ForwardCached is Forward for the tokens following the ones already in the cache,
+// their keys and values are reused instead of being recomputed. A nil cache means no caching.
+func (m *Model) ForwardCached(cache *Cache, tokens ...float64) *variable.Variable {
+	past := 0
+	if cache != nil {
+		past = cache.Len()
+	}
+
+	embeds := Rows(m.tokEmbeds, tokens...) // get embed for every input token
+	if m.posEmbeds != nil {
+		if past+len(tokens) > m.blockSize {
+			panic(fmt.Sprintf("context of %d tokens is longer than block size %d", past+len(tokens), m.blockSize))
+		}
+		embeds = Add(embeds, Rows(m.posEmbeds, positions(past, tokens)...)) // add positional embedding
+	}
+	if m.sinusoids {
+		embeds = Add(embeds, Sinusoidal(past, len(tokens), m.config.EmbedSize)) // computed for any position
+	}
+	for i, block := range m.blocks { // self-attention and feed-forward
+		var blockCache []*KVCache
+		if cache != nil {
+			blockCache = cache.heads[i]
+		}
+		embeds = block.ForwardCached(embeds, blockCache)
+	}
+	embeds = m.norm.Forward(embeds)
+
+	if m.lmHead == nil {
+		// Score of a token is the dot product with its own embed, the gradients of both uses add up.
+		return MatMul(embeds, Transpose(m.tokEmbeds))
+	}
+
+	return m.lmHead.Forward(embeds) // get scores for the next token for every context-enriched embed
+}
+
+// Scored returns the logits and the targets of the positions scored by the loss. With the prefix-LM mask
+// the tokens of the prefix but the last one see the token they predict, so they are left out.
+func (m *Model) Scored(logits, targets *variable.Variable) (*variable.Variable, *variable.Variable) {
+	first := m.firstScored(logits.N())
+	if first == 0 {
+		return logits, targets
+	}
+
+	rows := make([]float64, logits.N()-first)
+	for i := range rows {
+		rows[i] = float64(first + i)
+	}
+
+	return Rows(logits, rows...), variable.New(targets.Data.Data[first:]...)
+}
+
+// Returns the first position of T tokens which doesn't see its target, see Scored.
+func (m *Model) firstScored(T int) int {
+	return max(0, min(m.prefix, T)-1)
+}
+
+// AuxLoss returns the sum of the load balancing losses of the experts of the last Forward,
+// to be added to the training loss, nil if the blocks have no experts.
+func (m *Model) AuxLoss() *variable.Variable {
+	var loss *variable.Variable
+	for _, block := range m.blocks {
+		if block.moe == nil || block.moe.auxLoss == nil {
+			continue
+		}
+		if loss == nil {
+			loss = block.moe.AuxLoss()
+			continue
+		}
+		loss = Add(loss, block.moe.AuxLoss())
+	}
+
+	return loss
+}
+
+func (m *Model) Params() []layer.Parameter {
+	params := []layer.Parameter{m.tokEmbeds}
+	if m.posEmbeds != nil {
+		params = append(params, m.posEmbeds)
+	}
+	for _, block := range m.blocks {
+		params = append(params, block.Params()...)
+	}
+	params = append(params, m.norm.Params()...)
+	if m.lmHead != nil {
+		params = append(params, m.lmHead.Params()...)
+	}
+
+	return params
+}
+
+// ParamNames returns the names of Params in the same order, e.g. "tok_embeds" or "blocks.0.mlp.weight",
+// Linears are named by Linears, and norms by their blocks: "blocks.0.norm1.scale".
+func (m *Model) ParamNames() []string {
+	names := map[*variable.Variable]string{m.tokEmbeds: "tok_embeds"}
+	if m.posEmbeds != nil {
+		names[m.posEmbeds] = "pos_embeds"
+	}
+	for _, linear := range m.Linears() {
+		names[linear.Weight] = linear.Name + ".weight"
+		if linear.Biased {
+			names[linear.Bias] = linear.Name + ".bias"
+		}
+	}
+	nameNorm := func(prefix string, norm Norm) {
+		for i, param := range norm.Params() {
+			names[param] = prefix + []string{".scale", ".shift"}[i]
+		}
+	}
+	for i, block := range m.blocks {
+		nameNorm(fmt.Sprintf("blocks.%d.norm1", i), block.norm1)
+		nameNorm(fmt.Sprintf("blocks.%d.norm2", i), block.norm2)
+	}
+	nameNorm("norm", m.norm)
+
+	var ordered []string
+	for _, param := range m.Params() {
+		ordered = append(ordered, names[param])
+	}
+
+	return ordered
+}
+
+// Returns positions past, past+1, ..., past+len(tokens)-1.
+func positions(past int, tokens []float64) []float64 {
+	pos := make([]float64, len(tokens))
+	for i := range pos {
+		pos[i] = float64(past + i)
+	}
+
+	return pos
+}
+
+// Cache holds the keys and values of every attention head of every block,
+// so generation only runs the model on the new tokens, see Model.ForwardCached.
+type Cache struct {
+	heads [][]*KVCache // per block, per key and value head
+	Start int          // index of the first cached token in the context
+}
+
+func (m *Model) NewCache() *Cache {
+	cache := &Cache{}
+	for _, block := range m.blocks {
+		heads := make([]*KVCache, block.saHead.kvHeads)
+		for i := range heads {
+			heads[i] = &KVCache{}
+		}
+		cache.heads = append(cache.heads, heads)
+	}
+
+	return cache
+}
+
+// Len returns the number of cached tokens.
+func (c *Cache) Len() int {
+	return c.heads[0][0].Len()
+}
+
+// Reset empties the cache, start is the index of the first token to be cached next.
+func (c *Cache) Reset(start int) {
+	for _, heads := range c.heads {
+		for _, head := range heads {
+			*head = KVCache{}
+		}
+	}
+	c.Start = start
+}
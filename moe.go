@@ -0,0 +1,189 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+
+	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/variable"
+	"github.com/zakirullin/gpt-go/pkg"
+)
+
+// Weight of the load balancing loss in the training loss, as in Switch Transformer.
+const moeAuxWeight = 0.01
+
+// MoE is a mixture of experts replacing the MLP of a block: a router picks topK of the expert MLPs
+// for every token, and the token's output is the sum of their outputs weighted by the router probabilities.
+// Parameters grow with the number of experts, the compute per token grows only with topK.
+type MoE struct {
+	router   *Linear // scores of every expert for every token
+	experts  []*Expert
+	topK     int
+	capacity float64            // an expert takes at most capacity*topK*T/len(experts) of T tokens, 0 is no limit
+	auxLoss  *variable.Variable // load balancing loss of the last Forward
+}
+
+// Expert is an MLP of its own, the same as the MLP of the block.
+type Expert struct {
+	mlp        *Linear
+	mlpGate    *Linear // nil unless SwiGLU
+	mlpProj    *Linear
+	activation func(x ...*variable.Variable) *variable.Variable
+	dropout    float64
+}
+
+func NewMoE(embedSize, hiddenSize, numExperts, topK int, capacity float64, activation func(x ...*variable.Variable) *variable.Variable, swiGLU bool, dropout float64) *MoE {
+	if topK < 1 || topK > numExperts {
+		panic(fmt.Sprintf("can't route every token to %d of %d experts", topK, numExperts))
+	}
+
+	moe := &MoE{
+		router:   NewLinear(embedSize, numExperts, NoBias()),
+		topK:     topK,
+		capacity: capacity,
+	}
+	for range numExperts {
+		expert := &Expert{
+			mlp:        NewLinear(embedSize, hiddenSize),
+			mlpProj:    NewLinear(hiddenSize, embedSize),
+			activation: activation,
+			dropout:    dropout,
+		}
+		if swiGLU {
+			expert.mlpGate = NewLinear(embedSize, hiddenSize)
+		}
+		moe.experts = append(moe.experts, expert)
+	}
+
+	return moe
+}
+
+// Forward runs every expert on its tokens in a separate goroutine. Tokens over the capacity of an expert
+// skip it during training, so the busiest expert doesn't hold the others up, the residual carries them.
+// Generation and eval feed a few tokens at a time, so they aren't limited, every token gets its experts.
+func (moe *MoE) Forward(input *variable.Variable) *variable.Variable {
+	T, numExperts := input.N(), len(moe.experts)
+	probs := Softmax(moe.router.Forward(input)) // (T, numExperts)
+
+	// Choices are ranked, the first choices of all the tokens take the capacity before the second ones.
+	choices := moe.route(probs)
+	capacity := T * moe.topK
+	if moe.capacity > 0 && variable.Config.Train {
+		capacity = max(1, int(math.Ceil(moe.capacity*float64(T*moe.topK)/float64(numExperts))))
+	}
+	tokens := make([][]float64, numExperts) // indexes of the tokens of every expert
+	for rank := range moe.topK {
+		for token, experts := range choices {
+			if e := experts[rank]; len(tokens[e]) < capacity {
+				tokens[e] = append(tokens[e], float64(token))
+			}
+		}
+	}
+
+	outputs := make([]*variable.Variable, numExperts)
+	var wg sync.WaitGroup
+	for e, expert := range moe.experts {
+		if len(tokens[e]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[e] = expert.Forward(Rows(input, tokens[e]...))
+		}()
+	}
+	wg.Wait()
+
+	// Weigh the outputs by the probabilities of the experts, and add them to the rows of their tokens.
+	out := Zeros(T, input.Data.Cols)
+	gates := pkg.Split(probs, numExperts) // (T, 1) probabilities of every expert
+	for e, output := range outputs {
+		if output == nil {
+			continue
+		}
+		weighted := Mul(Rows(gates[e], tokens[e]...), output)
+		out = Add(out, variable.GetItemGrad(indexes(tokens[e]), []int{T, input.Data.Cols})(weighted))
+	}
+
+	moe.auxLoss = moe.balance(probs, choices)
+	return out
+}
+
+// Returns the indexes of the topK experts of every token, the most probable first.
+func (moe *MoE) route(probs *variable.Variable) [][]int {
+	choices := make([][]int, probs.N())
+	for token := range choices {
+		row := probs.Data.Row(token)
+		experts := make([]int, len(row))
+		for e := range experts {
+			experts[e] = e
+		}
+		slices.SortStableFunc(experts, func(a, b int) int { return cmp.Compare(row[b], row[a]) })
+		choices[token] = experts[:moe.topK]
+	}
+
+	return choices
+}
+
+// Returns the load balancing loss: numExperts * Σ fraction of choices of the expert * mean probability of the expert.
+// It's the smallest when the tokens are spread evenly, the gradient flows through the probabilities only.
+func (moe *MoE) balance(probs *variable.Variable, choices [][]int) *variable.Variable {
+	T, numExperts := probs.N(), len(moe.experts)
+	fractions := Zeros(numExperts, 1)
+	for _, experts := range choices {
+		for _, e := range experts {
+			fractions.Data.Data[e] += 1 / float64(T*moe.topK)
+		}
+	}
+
+	meanProbs := MatMul(MulC(1/float64(T), Ones(1, T)), probs) // (1, numExperts)
+	return MulC(float64(numExperts), MatMul(meanProbs, fractions))
+}
+
+// AuxLoss returns the weighted load balancing loss of the last Forward, nil before the first one.
+func (moe *MoE) AuxLoss() *variable.Variable {
+	if moe.auxLoss == nil {
+		return nil
+	}
+
+	return MulC(moeAuxWeight, moe.auxLoss)
+}
+
+func (moe *MoE) Params() []layer.Parameter {
+	params := []layer.Parameter{moe.router.Weight}
+	for _, expert := range moe.experts {
+		params = append(params, expert.Params()...)
+	}
+
+	return params
+}
+
+func (e *Expert) Forward(input *variable.Variable) *variable.Variable {
+	activated := e.activation(e.mlp.Forward(input))
+	if e.mlpGate != nil {
+		activated = Mul(activated, e.mlpGate.Forward(input))
+	}
+
+	return Dropout(e.dropout)(e.mlpProj.Forward(activated))
+}
+
+func (e *Expert) Params() []layer.Parameter {
+	params := []layer.Parameter{e.mlp.Weight, e.mlp.Bias, e.mlpProj.Weight, e.mlpProj.Bias}
+	if e.mlpGate != nil {
+		params = append(params, e.mlpGate.Weight, e.mlpGate.Bias)
+	}
+
+	return params
+}
+
+func indexes(tokens []float64) []int {
+	ints := make([]int, len(tokens))
+	for i, token := range tokens {
+		ints[i] = int(token)
+	}
+
+	return ints
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"math"
+
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+// GELU is x*Φ(x), where Φ is the cumulative distribution function of the standard normal distribution.
+// Unlike ReLU it's smooth and lets small negative values through.
+func GELU(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &ActivationT{F: gelu, Df: geluDf}}).First(x...)
+}
+
+// GELUTanh is the tanh approximation of GELU used by GPT-2.
+func GELUTanh(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &ActivationT{F: geluTanh, Df: geluTanhDf}}).First(x...)
+}
+
+// SiLU (also known as swish) is x*sigmoid(x).
+func SiLU(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &ActivationT{F: silu, Df: siluDf}}).First(x...)
+}
+
+// ActivationT applies F to every element, Df is its derivative.
+type ActivationT struct {
+	F, Df func(x float64) float64
+	x     *variable.Variable
+}
+
+func (f *ActivationT) Forward(x ...*variable.Variable) []*variable.Variable {
+	f.x = x[0]
+
+	return []*variable.Variable{
+		variable.NewFrom(matrix.F(x[0].Data, f.F)),
+	}
+}
+
+func (f *ActivationT) Backward(gy ...*variable.Variable) []*variable.Variable {
+	return []*variable.Variable{
+		variable.Mul(gy[0], variable.NewFrom(matrix.F(f.x.Data, f.Df))),
+	}
+}
+
+const sqrt2OverPi = 0.7978845608028654 // sqrt(2/π)
+
+func gelu(x float64) float64 {
+	return 0.5 * x * (1 + math.Erf(x/math.Sqrt2))
+}
+
+func geluDf(x float64) float64 {
+	cdf := 0.5 * (1 + math.Erf(x/math.Sqrt2))
+	pdf := math.Exp(-0.5*x*x) / math.Sqrt(2*math.Pi)
+
+	return cdf + x*pdf
+}
+
+func geluTanh(x float64) float64 {
+	return 0.5 * x * (1 + math.Tanh(sqrt2OverPi*(x+0.044715*x*x*x)))
+}
+
+func geluTanhDf(x float64) float64 {
+	t := math.Tanh(sqrt2OverPi * (x + 0.044715*x*x*x))
+
+	return 0.5*(1+t) + 0.5*x*(1-t*t)*sqrt2OverPi*(1+3*0.044715*x*x)
+}
+
+func silu(x float64) float64 {
+	return x * sigmoid(x)
+}
+
+func siluDf(x float64) float64 {
+	s := sigmoid(x)
+
+	return s * (1 + x*(1-s))
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
@@ -0,0 +1,22 @@
+package pkg
+
+import "fmt"
+
+func ExampleGELU() {
+	x := M{{-1, 0, 1, 3}}.Var()
+
+	fmt.Printf("%.4f\n", GELU(x).Data.Row(0))
+	fmt.Printf("%.4f\n", GELUTanh(x).Data.Row(0))
+
+	// Output:
+	// [-0.1587 0.0000 0.8413 2.9960]
+	// [-0.1588 0.0000 0.8412 2.9964]
+}
+
+func ExampleSiLU() {
+	x := M{{-1, 0, 1, 3}}.Var()
+
+	fmt.Printf("%.4f\n", SiLU(x).Data.Row(0))
+
+	// Output: [-0.2689 0.0000 0.7311 2.8577]
+}
@@ -22,8 +22,15 @@ func NewAdamW(learningRate float64) AdamW {
 	return AdamW{Alpha: learningRate, Beta1: 0.9, Beta2: 0.999, WeightDecay: 0.01}
 }
 
+// Reset forgets the moments, e.g. when the params are loaded from a checkpoint.
+func (o *AdamW) Reset() {
+	o.iter = 0
+	o.ms, o.vs = nil, nil
+}
+
 func (o *AdamW) Update(model optimizer.Model) {
 	params := optimizer.Params(model, o.Hook)
+	frozen, _ := model.(*Params) // nil for other models, nothing is frozen then
 
 	if len(o.ms) == 0 {
 		o.ms = make(map[*variable.Variable]*matrix.Matrix)
@@ -36,6 +43,9 @@ func (o *AdamW) Update(model optimizer.Model) {
 	lr := o.Alpha * math.Sqrt(fix2) / fix1
 
 	for _, p := range params {
+		if frozen.IsFrozen(p) {
+			continue
+		}
 		if _, ok := o.ms[p]; !ok {
 			o.ms[p] = matrix.ZeroLike(p.Data)
 			o.vs[p] = matrix.ZeroLike(p.Data)
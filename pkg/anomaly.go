@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+var anomalyDetection = false
+
+// DetectAnomaly enables the checks of activations and gradients for NaN and Inf values
+// in DataParallel.Step. It slows down the training, so it's meant for debugging:
+//
+//	defer pkg.DetectAnomaly().End()
+func DetectAnomaly() *variable.Span {
+	anomalyDetection = true
+	return &variable.Span{
+		End: func() {
+			anomalyDetection = false
+		},
+	}
+}
+
+// CheckForward returns an error naming the first function in the graph of y
+// that produced NaN or Inf values from inputs without them.
+// Inputs are allowed to have infinities, e.g. MaskedInfFill fills masked values with -Inf
+// on purpose, so only the functions introducing new kinds of non-finite values are reported.
+func CheckForward(y *variable.Variable) error {
+	for _, f := range functions(y) {
+		if _, ok := f.Forwarder.(*MaskedT); ok {
+			continue // produces -Inf on purpose, copies the rest as is
+		}
+		if introduced(f.Input, f.Output) {
+			return fmt.Errorf("forward: %s produced non-finite values, inputs: %s", name(f), shapes(f.Input))
+		}
+	}
+
+	return nil
+}
+
+// CheckBackward returns an error naming the first function in the graph of y whose backward
+// produced NaN or Inf gradients. Intermediate gradients must be retained:
+//
+//	y.Backward(variable.Opts{RetainGrad: true})
+func CheckBackward(y *variable.Variable) error {
+	fs := functions(y)
+	slices.Reverse(fs) // in the order of backward
+	for _, f := range fs {
+		if introduced(grads(f.Output), grads(f.Input)) {
+			return fmt.Errorf("backward: %s produced non-finite gradients, inputs: %s", name(f), shapes(f.Input))
+		}
+	}
+
+	return nil
+}
+
+// IsFinite reports whether all the values are neither NaN nor Inf.
+func IsFinite(values ...float64) bool {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the functions of the graph of y in the order of forward.
+func functions(y *variable.Variable) []*variable.Function {
+	var fs []*variable.Function
+	seen := make(map[*variable.Function]bool)
+	queue := []*variable.Variable{y}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if v.Creator == nil || seen[v.Creator] {
+			continue
+		}
+
+		seen[v.Creator] = true
+		fs = append(fs, v.Creator)
+		queue = append(queue, v.Creator.Input...)
+	}
+
+	slices.SortStableFunc(fs, func(a, b *variable.Function) int {
+		return a.Generation - b.Generation
+	})
+
+	return fs
+}
+
+// Reports whether outputs have NaN, while inputs don't, or outputs have Inf, while inputs don't.
+func introduced(inputs, outputs []*variable.Variable) bool {
+	inNaN, inInf := nonFinite(inputs)
+	outNaN, outInf := nonFinite(outputs)
+
+	return (outNaN && !inNaN) || (outInf && !inInf)
+}
+
+func nonFinite(vars []*variable.Variable) (hasNaN, hasInf bool) {
+	for _, v := range vars {
+		if v == nil {
+			continue
+		}
+		for _, x := range v.Data.Data {
+			hasNaN = hasNaN || math.IsNaN(x)
+			hasInf = hasInf || math.IsInf(x, 0)
+		}
+	}
+
+	return hasNaN, hasInf
+}
+
+func grads(vars []*variable.Variable) []*variable.Variable {
+	out := make([]*variable.Variable, len(vars))
+	for i, v := range vars {
+		out[i] = v.Grad
+	}
+
+	return out
+}
+
+// Returns the name of the function, e.g. pkg.MatMulT.
+func name(f *variable.Function) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", f.Forwarder), "*")
+}
+
+func shapes(vars []*variable.Variable) string {
+	var out []string
+	for _, v := range vars {
+		out = append(out, fmt.Sprintf("%d×%d", v.Data.Rows, v.Data.Cols))
+	}
+
+	return strings.Join(out, ", ")
+}
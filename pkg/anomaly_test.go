@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/itsubaki/autograd/function"
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleCheckForward() {
+	a := M{
+		{1, 2},
+		{3, 4},
+	}.Var()
+	b := M{
+		{-1},
+		{0},
+	}.Var()
+
+	y := variable.Log(MatMul(a, b)) // log of negative values is NaN
+	fmt.Println(CheckForward(y))
+
+	// Output: forward: variable.LogT produced non-finite values, inputs: 2×1
+}
+
+func ExampleCheckForward_maskedInfFill() {
+	// Infinities of the masked attention are expected, softmax turns them into zeros.
+	a := Normal(3, 3)
+	y := function.Softmax(MaskedInfFill(a, Tril(Ones(3, 3))))
+	fmt.Println(CheckForward(y))
+
+	// Output: <nil>
+}
+
+func ExampleCheckBackward() {
+	a := M{
+		{0, 1},
+	}.Var()
+
+	y := MatMul(variable.Pow(0.5)(a), Ones(2, 2)) // derivative of sqrt(x) is infinite at x=0
+	y.Backward(variable.Opts{RetainGrad: true})
+	fmt.Println(CheckForward(y))
+	fmt.Println(CheckBackward(y))
+
+	// Output:
+	// <nil>
+	// backward: variable.PowT produced non-finite gradients, inputs: 1×2
+}
+
+func ExampleIsFinite() {
+	fmt.Println(IsFinite(1, 2, 3))
+	fmt.Println(IsFinite(1, math.NaN()))
+	fmt.Println(IsFinite(math.Inf(-1)))
+
+	// Output:
+	// true
+	// false
+	// false
+}
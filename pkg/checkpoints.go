@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+)
+
+// Checkpoints saves the params during the training, only the last Keep checkpoints are kept on disk.
+type Checkpoints struct {
+	Keep   int
+	params *Params
+	saved  []string
+}
+
+func NewCheckpoints(params *Params, keep int) *Checkpoints {
+	return &Checkpoints{Keep: keep, params: params}
+}
+
+// Save writes the params to a file named after the step and removes the oldest checkpoints.
+func (c *Checkpoints) Save(step int) string {
+	filename := fmt.Sprintf("%s-step%d", c.params.Filename(), step)
+	c.params.SaveAs(filename)
+	c.saved = append(c.saved, filename)
+
+	for len(c.saved) > max(c.Keep, 1) {
+		if err := os.Remove(c.saved[0]); err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+		c.saved = c.saved[1:]
+	}
+
+	return filename
+}
+
+// Last returns the file name of the last saved checkpoint, empty if none was saved.
+func (c *Checkpoints) Last() string {
+	if len(c.saved) == 0 {
+		return ""
+	}
+
+	return c.saved[len(c.saved)-1]
+}
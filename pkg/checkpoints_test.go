@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+)
+
+func ExampleCheckpoints_rotation() {
+	dir, _ := os.MkdirTemp("", "checkpoints")
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	params := NewParams()
+	params.Add(M{{1, 2}}.Var())
+
+	checkpoints := NewCheckpoints(params, 2)
+	for step := range 4 {
+		fmt.Println(checkpoints.Save(step * 100))
+	}
+
+	files, _ := os.ReadDir(".")
+	for _, file := range files {
+		fmt.Println(file.Name())
+	}
+
+	// Output:
+	// model-0.000M-step0
+	// model-0.000M-step100
+	// model-0.000M-step200
+	// model-0.000M-step300
+	// model-0.000M-step200
+	// model-0.000M-step300
+}
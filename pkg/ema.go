@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+// EMA tracks an exponential moving average of the params:
+// shadow = decay * shadow + (1 - decay) * param.
+// Averaged weights are less noisy than the weights of the last step,
+// so they usually give better samples for small models.
+type EMA struct {
+	Decay  float64
+	params *Params
+	shadow map[*variable.Variable]*matrix.Matrix
+	iter   int
+}
+
+func NewEMA(params *Params, decay float64) *EMA {
+	e := &EMA{
+		Decay:  decay,
+		params: params,
+		shadow: make(map[*variable.Variable]*matrix.Matrix),
+	}
+	for _, p := range params.Params() {
+		e.shadow[p] = matrix.F(p.Data, copyVal)
+	}
+
+	return e
+}
+
+// Reset starts the average anew from the current params, e.g. when they are loaded from a checkpoint.
+func (e *EMA) Reset() {
+	e.iter = 0
+	for _, p := range e.params.Params() {
+		e.shadow[p] = matrix.F(p.Data, copyVal)
+	}
+}
+
+// Update moves the shadow weights towards the current params.
+// Should be called after every optimizer update.
+func (e *EMA) Update() {
+	e.iter++
+	// Warm up the decay, so the random initial weights are forgotten quickly.
+	decay := min(e.Decay, float64(1+e.iter)/float64(10+e.iter))
+
+	for _, p := range e.params.Params() {
+		shadow, ok := e.shadow[p]
+		if !ok {
+			e.shadow[p] = matrix.F(p.Data, copyVal)
+			continue
+		}
+
+		e.shadow[p] = matrix.F2(shadow, p.Data, func(s, w float64) float64 {
+			return decay*s + (1-decay)*w
+		})
+	}
+}
+
+// Apply replaces the params with their averaged values. Calling End on the
+// returned span restores the original weights, so the training can continue:
+//
+//	defer ema.Apply().End()
+func (e *EMA) Apply() *variable.Span {
+	backup := make(map[*variable.Variable]*matrix.Matrix)
+	for _, p := range e.params.Params() {
+		backup[p] = p.Data
+		if shadow, ok := e.shadow[p]; ok {
+			p.Data = matrix.F(shadow, copyVal)
+		}
+	}
+
+	return &variable.Span{
+		End: func() {
+			for p, data := range backup {
+				p.Data = data
+			}
+		},
+	}
+}
+
+func copyVal(v float64) float64 {
+	return v
+}
@@ -0,0 +1,41 @@
+package pkg
+
+import "fmt"
+
+func ExampleEMA_update() {
+	w := M{
+		{0, 0},
+	}.Var()
+	params := NewParams()
+	params.Add(w)
+
+	ema := NewEMA(params, 0.5)
+	w.Data = M{{4, 8}}.Var().Data
+	ema.Update() // decay is warmed up: min(0.5, 2/11)
+
+	span := ema.Apply()
+	fmt.Printf("%.4f %.4f\n", w.Data.At(0, 0), w.Data.At(0, 1))
+	span.End()
+	fmt.Println(w.Data)
+
+	// Output:
+	// 3.2727 6.5455
+	// [[4 8]]
+}
+
+func ExampleEMA_decay() {
+	w := V{0}.Var()
+	params := NewParams()
+	params.Add(w)
+
+	ema := NewEMA(params, 0.5)
+	for range 3 {
+		w.Data = V{1}.Var().Data
+		ema.Update() // shadow moves towards w
+	}
+
+	ema.Apply()
+	fmt.Printf("%.6f\n", Val(w))
+
+	// Output: 0.986014
+}
@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+const flashTile = 32 // number of keys processed at once
+
+// FlashAttention computes softmax(Q·Kᵀ + bias)·V of the allowed query and key pairs: FlashAttention(allowed, bias)(q, k, v).
+// Scores are computed for a tile of keys at a time and the softmax is accumulated online, rescaling
+// the partial sums whenever the maximum score grows, so the (T, T) matrices of scores and probabilities
+// are never stored: the memory is O(T), not O(T²). Backward recomputes the scores from Q and K.
+// Bias may be nil, rows without allowed keys are zeros.
+func FlashAttention(allowed func(row, col int) bool, bias func(row, col int) float64) func(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &FlashAttentionT{Allowed: allowed, Bias: bias}}).First
+}
+
+type FlashAttentionT struct {
+	Allowed   func(row, col int) bool
+	Bias      func(row, col int) float64
+	q, k, v   *matrix.Matrix
+	out       *matrix.Matrix
+	logSumExp []float64 // of the scores of every row, to recompute the probabilities in backward
+}
+
+func (f *FlashAttentionT) Forward(x ...*variable.Variable) []*variable.Variable {
+	f.q, f.k, f.v = x[0].Data, x[1].Data, x[2].Data
+	f.out = matrix.Zero(f.q.Rows, f.v.Cols)
+	f.logSumExp = make([]float64, f.q.Rows)
+
+	parallel(f.q.Rows, func(i int) {
+		maxScore, sum := math.Inf(-1), 0.0
+		acc := f.out.Row(i) // unnormalized weighted sum of values
+		scores := make([]float64, flashTile)
+		for tile := 0; tile < f.k.Rows; tile += flashTile {
+			end := min(tile+flashTile, f.k.Rows)
+
+			// Scores of the tile, rescale the sums if there's a new maximum.
+			tileMax := math.Inf(-1)
+			for j := tile; j < end; j++ {
+				scores[j-tile] = f.score(i, j)
+				tileMax = max(tileMax, scores[j-tile])
+			}
+			if math.IsInf(tileMax, -1) {
+				continue // all masked
+			}
+			if tileMax > maxScore {
+				rescale := math.Exp(maxScore - tileMax)
+				sum *= rescale
+				for c := range acc {
+					acc[c] *= rescale
+				}
+				maxScore = tileMax
+			}
+
+			for j := tile; j < end; j++ {
+				p := math.Exp(scores[j-tile] - maxScore) // zero if masked
+				if p == 0 {
+					continue
+				}
+				sum += p
+				for c, vc := range f.v.Row(j) {
+					acc[c] += p * vc
+				}
+			}
+		}
+
+		if sum == 0 {
+			f.logSumExp[i] = math.Inf(-1)
+			return
+		}
+		for c := range acc {
+			acc[c] /= sum
+		}
+		f.logSumExp[i] = maxScore + math.Log(sum)
+	})
+
+	return []*variable.Variable{variable.NewFrom(f.out)}
+}
+
+// With probabilities p = exp(score - logSumExp) and D_i = dOut_i·out_i:
+// dV_j = Σ_i p_ij dOut_i, dScore_ij = p_ij (dOut_i·v_j - D_i), dQ_i = Σ_j dScore_ij k_j, dK_j = Σ_i dScore_ij q_i.
+// Queries and keys are processed in two separate passes, so every goroutine writes only its own rows.
+func (f *FlashAttentionT) Backward(gy ...*variable.Variable) []*variable.Variable {
+	dOut := gy[0].Data
+	D := make([]float64, f.q.Rows)
+	for i := range D {
+		D[i] = dot(dOut.Row(i), f.out.Row(i))
+	}
+
+	dScore := func(i, j int) (p, ds float64) {
+		s := f.score(i, j)
+		if math.IsInf(s, -1) {
+			return 0, 0
+		}
+		p = math.Exp(s - f.logSumExp[i])
+		return p, p * (dot(dOut.Row(i), f.v.Row(j)) - D[i])
+	}
+
+	dq := matrix.ZeroLike(f.q)
+	parallel(f.q.Rows, func(i int) {
+		for j := range f.k.Rows {
+			if _, ds := dScore(i, j); ds != 0 {
+				axpy(dq.Row(i), ds, f.k.Row(j))
+			}
+		}
+	})
+
+	dk, dv := matrix.ZeroLike(f.k), matrix.ZeroLike(f.v)
+	parallel(f.k.Rows, func(j int) {
+		for i := range f.q.Rows {
+			p, ds := dScore(i, j)
+			if p == 0 {
+				continue
+			}
+			axpy(dv.Row(j), p, dOut.Row(i))
+			axpy(dk.Row(j), ds, f.q.Row(i))
+		}
+	})
+
+	return []*variable.Variable{variable.NewFrom(dq), variable.NewFrom(dk), variable.NewFrom(dv)}
+}
+
+// Returns the score of the query i and the key j, -Inf if not allowed.
+func (f *FlashAttentionT) score(i, j int) float64 {
+	if !f.Allowed(i, j) {
+		return math.Inf(-1)
+	}
+
+	s := dot(f.q.Row(i), f.k.Row(j))
+	if f.Bias != nil {
+		s += f.Bias(i, j)
+	}
+
+	return s
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+
+	return sum
+}
+
+// a += c*b
+func axpy(a []float64, c float64, b []float64) {
+	for i := range a {
+		a[i] += c * b[i]
+	}
+}
+
+// Calls f for every row in parallel, rows are split into chunks as in matmul.
+func parallel(rows int, f func(row int)) {
+	var wg sync.WaitGroup
+	chunkSize := max(1, rows/(runtime.NumCPU()*4))
+	for start := 0; start < rows; start += chunkSize {
+		wg.Add(1)
+		go func(first, last int) {
+			defer wg.Done()
+			for row := first; row < last; row++ {
+				f(row)
+			}
+		}(start, min(start+chunkSize, rows))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/itsubaki/autograd/function"
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleFlashAttention() {
+	q, k, v := Normal(70, 4), Normal(70, 4), Normal(70, 3)
+	causal := func(row, col int) bool { return col <= row }
+
+	// Scores of 70 keys don't fit a single tile.
+	want := MatMul(function.Softmax(Masked(causal)(MatMul(q, variable.Transpose(k)))), v)
+	got := FlashAttention(causal, nil)(q, k, v)
+
+	maxDiff := 0.0
+	for i := range want.Data.Data {
+		maxDiff = max(maxDiff, math.Abs(want.Data.Data[i]-got.Data.Data[i]))
+	}
+	fmt.Println(maxDiff < 1e-12)
+
+	// Output: true
+}
+
+func ExampleFlashAttention_masked() {
+	q := M{{1, 0}, {0, 1}}.Var()
+	k := M{{1, 0}, {0, 1}}.Var()
+	v := M{{1, 2}, {3, 4}}.Var()
+
+	// The first query sees no keys, the second one sees only the first key.
+	y := FlashAttention(func(row, col int) bool { return col < row }, nil)(q, k, v)
+	fmt.Println(y.Data)
+
+	// Output: [[0 0] [1 2]]
+}
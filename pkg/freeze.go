@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+// IsFrozen reports whether the param is frozen, see Freeze. Nothing is frozen in nil Params.
+func (p *Params) IsFrozen(param *variable.Variable) bool {
+	return p != nil && p.frozen[param]
+}
+
+// Freeze freezes the params matching any of the patterns, so they keep their values: AdamW skips them,
+// DataParallel and GradNorm leave out their gradients (the backward pass still computes them).
+// A pattern matches the name of a param, the names starting with it and a dot (e.g. "blocks.0"
+// matches every param of the first block), or is a glob of the name (e.g. "*_embeds").
+// Params are named by SetNames, by their indexes otherwise.
+func (p *Params) Freeze(patterns ...string) {
+	p.setFrozen(true, patterns)
+}
+
+// Unfreeze unfreezes the params matching any of the patterns, see Freeze.
+func (p *Params) Unfreeze(patterns ...string) {
+	p.setFrozen(false, patterns)
+}
+
+// CountFrozen returns the number of values of the frozen params.
+func (p *Params) CountFrozen() int {
+	numParams := 0
+	for _, param := range p.params {
+		if p.frozen[param] {
+			numParams += param.Data.Rows * param.Data.Cols
+		}
+	}
+
+	return numParams
+}
+
+func (p *Params) setFrozen(freeze bool, patterns []string) {
+	for _, pattern := range patterns {
+		matched := false
+		for i := range len(p.params) {
+			if !matchesName(pattern, p.name(i)) {
+				continue
+			}
+			matched = true
+			param := p.params[fmt.Sprintf("%d", i)]
+			if freeze {
+				p.frozen[param] = true
+			} else {
+				delete(p.frozen, param)
+			}
+		}
+		if !matched {
+			panic(fmt.Sprintf("no params match '%s'", pattern))
+		}
+	}
+}
+
+func matchesName(pattern, name string) bool {
+	if pattern == name || strings.HasPrefix(name, pattern+".") {
+		return true
+	}
+	matched, err := path.Match(pattern, name)
+	if err != nil {
+		panic(fmt.Sprintf("invalid pattern '%s': %v", pattern, err))
+	}
+
+	return matched
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleParams_Freeze() {
+	embeds, w0, w1 := M{{1, 2}}.Var(), M{{1}, {2}}.Var(), M{{3}}.Var()
+	params := NewParams()
+	params.Add(embeds, w0, w1)
+	params.SetNames("tok_embeds", "blocks.0.mlp.weight", "blocks.1.mlp.weight")
+
+	params.Freeze("*_embeds", "blocks.0")
+	fmt.Println(params.IsFrozen(embeds), params.IsFrozen(w0), params.IsFrozen(w1))
+	fmt.Println(params.CountFrozen(), params.Count())
+
+	params.Unfreeze("blocks.*")
+	fmt.Println(params.IsFrozen(embeds), params.IsFrozen(w0), params.IsFrozen(w1))
+
+	// Output:
+	// true true false
+	// 4 5
+	// true false false
+}
+
+func ExampleParams_Freeze_training() {
+	x, w0, w1 := M{{1, 2}}.Var(), M{{1}, {2}}.Var(), M{{3}}.Var()
+	params := NewParams()
+	params.Add(w0, w1)
+	params.Freeze("0")
+
+	// The frozen weight is used twice, its gradients add up as usual.
+	h := MatMul(x, w0)
+	y := variable.Add(MatMul(h, w1), MatMul(x, w0))
+	y.Backward()
+	fmt.Println(w0.Grad, w1.Grad)
+	fmt.Println(params.GradNorm())
+
+	// The optimizer doesn't update the frozen weight.
+	optimizer := NewAdamW(0.1)
+	optimizer.Update(params)
+	fmt.Println(w0.Data)
+	fmt.Printf("%.4f\n", w1.Data.At(0, 0))
+
+	// Output:
+	// variable([[4] [8]]) variable([5])
+	// 5
+	// [[1] [2]]
+	// 2.8991
+}
+
+func ExampleParams_Freeze_unknown() {
+	params := NewParams()
+	params.Add(variable.New(1))
+
+	defer func() {
+		fmt.Println(recover())
+	}()
+	params.Freeze("blocks.0")
+
+	// Output: no params match 'blocks.0'
+}
@@ -101,12 +101,12 @@ func Tril(m *variable.Variable) *variable.Variable {
 
 // The result would be added to computation graph and tied to m.
 func MaskedInfFill(m, mask *variable.Variable) *variable.Variable {
-	negInfMaskedData := matrix.F2(m.Data, mask.Data, func(a, b float64) float64 {
+	negInfMaskedData := matrix.F2(m.Data, mask.Data, func(_, b float64) float64 {
 		if b == 0 {
 			return math.Inf(-1)
 		}
 
-		return a
+		return 0 // unmasked values come from m*mask, filling them with m too doubled them
 	})
 	mMasked := Add(variable.Mul(m, mask), variable.NewFrom(negInfMaskedData))
 
@@ -146,3 +146,23 @@ func Millions(num int) float64 {
 func DisableDropout() {
 	variable.Config.Train = false // disables dropout
 }
+
+// Sinusoidal returns the fixed position encodings of the original Transformer for positions
+// offset, ..., offset+rows-1: sin(pos/10000^(2i/cols)) for even features, cos for odd ones.
+// Every feature is a wave of a different length, so any position has a unique encoding.
+func Sinusoidal(offset, rows, cols int) *variable.Variable {
+	m := matrix.Zero(rows, cols)
+	for i := range rows {
+		pos := float64(offset + i)
+		for j := range cols {
+			angle := pos / math.Pow(10000, float64(j-j%2)/float64(cols))
+			if j%2 == 0 {
+				m.Set(i, j, math.Sin(angle))
+			} else {
+				m.Set(i, j, math.Cos(angle))
+			}
+		}
+	}
+
+	return variable.NewFrom(m)
+}
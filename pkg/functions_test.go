@@ -0,0 +1,19 @@
+package pkg
+
+import "fmt"
+
+func ExampleSinusoidal() {
+	// Positions 0 and 1: sin(pos), cos(pos), sin(pos/100), cos(pos/100).
+	pe := Sinusoidal(0, 2, 4)
+	for _, row := range pe.Data.Seq2() {
+		fmt.Printf("%.4f\n", row)
+	}
+
+	// Encodings don't depend on the offset they are computed from.
+	fmt.Println(Sinusoidal(1, 1, 4).Data.Row(0)[0] == pe.Data.At(1, 0))
+
+	// Output:
+	// [0.0000 1.0000 0.0000 1.0000]
+	// [0.8415 0.5403 0.0100 1.0000]
+	// true
+}
@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+const (
+	gradCheckEps  = 1e-6 // step of the finite differences
+	gradCheckRTol = 1e-4 // relative tolerance
+	gradCheckATol = 1e-7 // absolute tolerance, for gradients close to zero
+)
+
+// GradCheck compares the gradients computed by Backward with the numerical ones,
+// computed with central finite differences: (f(x+eps) - f(x-eps)) / 2eps.
+// Inputs are perturbed in place, so f may ignore some inputs and use them indirectly,
+// e.g. x can contain the params of a layer used inside f.
+// Returns an error describing the first mismatched gradient.
+func GradCheck(f func(x ...*variable.Variable) *variable.Variable, x ...*variable.Variable) error {
+	for _, v := range x {
+		v.Cleargrad()
+	}
+
+	// The output is reduced to a scalar with random weights, so every output element
+	// contributes to the gradient differently and mistakes can't cancel each other out.
+	rnd := rand.New(rand.NewPCG(1, 2))
+	y := f(x...)
+	gy := variable.ZeroLike(y)
+	for i := range gy.Data.Data {
+		gy.Data.Data[i] = rnd.Float64()*2 - 1
+	}
+	y.Grad = gy
+	y.Backward()
+
+	reduced := func() float64 {
+		defer variable.Nograd().End()
+
+		var sum float64
+		for i, v := range f(x...).Data.Data {
+			sum += v * gy.Data.Data[i]
+		}
+
+		return sum
+	}
+
+	for i, v := range x {
+		for j, orig := range v.Data.Data {
+			v.Data.Data[j] = orig + gradCheckEps
+			plus := reduced()
+			v.Data.Data[j] = orig - gradCheckEps
+			minus := reduced()
+			v.Data.Data[j] = orig
+
+			numerical := (plus - minus) / (2 * gradCheckEps)
+			analytical := 0.0
+			if v.Grad != nil {
+				analytical = v.Grad.Data.Data[j]
+			}
+
+			if math.Abs(analytical-numerical) > gradCheckATol+gradCheckRTol*math.Abs(numerical) {
+				return fmt.Errorf("input %d %v, element %d: backward gradient %.6g, numerical gradient %.6g",
+					i, variable.Shape(v), j, analytical, numerical)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/itsubaki/autograd/function"
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleGradCheck_matMul() {
+	a := Normal(3, 4)
+	b := Normal(4, 2)
+
+	fmt.Println(GradCheck(MatMul, a, b))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_cat() {
+	a := Normal(3, 2)
+	b := Normal(3, 2)
+	c := Normal(3, 2)
+
+	fmt.Println(GradCheck(Cat, a, b, c))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_mean() {
+	a := Normal(3, 4)
+
+	fmt.Println(GradCheck(Mean, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_variance() {
+	a := M{
+		{1, 3, 5},
+		{-1, 0, 2},
+	}.Var()
+
+	fmt.Println(GradCheck(Variance, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_rows() {
+	a := Normal(4, 3)
+	rows := func(x ...*variable.Variable) *variable.Variable {
+		return Rows(x[0], 0, 2, 2, -1)
+	}
+
+	fmt.Println(GradCheck(rows, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_maskedInfFill() {
+	a := Normal(3, 3)
+	masked := func(x ...*variable.Variable) *variable.Variable {
+		// Infinities are turned into zeros by softmax, like in attention.
+		return function.Softmax(MaskedInfFill(x[0], Tril(Ones(3, 3))))
+	}
+
+	fmt.Println(GradCheck(masked, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_divC() {
+	a := Normal(2, 3)
+	div := func(x ...*variable.Variable) *variable.Variable {
+		return DivC(4, x[0])
+	}
+
+	fmt.Println(GradCheck(div, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_split() {
+	a := Normal(3, 6)
+	split := func(x ...*variable.Variable) *variable.Variable {
+		parts := Split(x[0], 3)
+		return Cat(parts[2], parts[0], parts[2])
+	}
+
+	fmt.Println(GradCheck(split, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_roPE() {
+	a := Normal(3, 6)
+
+	fmt.Println(GradCheck(RoPE(2), a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_activations() {
+	a := M{
+		{-2.5, -0.7, 0.01, 0.4},
+		{1.3, 3, -1.1, 0},
+	}.Var()
+
+	fmt.Println(GradCheck(GELU, a))
+	fmt.Println(GradCheck(GELUTanh, a))
+	fmt.Println(GradCheck(SiLU, a))
+
+	// Output:
+	// <nil>
+	// <nil>
+	// <nil>
+}
+
+func ExampleGradCheck_norms() {
+	x := M{
+		{1, -2, 0.5, 3},
+		{0.1, 0.2, -0.4, 0},
+	}.Var()
+	scale := M{{1, 0.5, -2, 1.5}}.Var()
+	shift := M{{0.1, 0, 0.3, -1}}.Var()
+
+	fmt.Println(GradCheck(LayerNorm(1e-5), x, scale, shift))
+	fmt.Println(GradCheck(RMSNorm(1e-5), x, scale))
+
+	// Output:
+	// <nil>
+	// <nil>
+}
+
+func ExampleGradCheck_masked() {
+	a := Normal(3, 3)
+	masked := func(x ...*variable.Variable) *variable.Variable {
+		// Masked values are -Inf, Softmax turns them into zeros.
+		return function.Softmax(Masked(func(row, col int) bool { return col <= row })(x...))
+	}
+
+	fmt.Println(GradCheck(masked, a))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_flashAttention() {
+	q := M{
+		{0.5, -1, 0.3},
+		{1.2, 0.1, -0.7},
+		{-0.4, 0.8, 0.9},
+		{0.2, 0.6, -1.1},
+	}.Var()
+	k := M{
+		{-0.3, 0.7, 1},
+		{0.9, -0.5, 0.2},
+		{0.4, 0.4, -0.8},
+		{-1, 0.1, 0.6},
+	}.Var()
+	v := Normal(4, 2)
+	window := func(row, col int) bool { return col <= row && row-col < 3 }
+	bias := func(row, col int) float64 { return -0.5 * float64(row-col) }
+
+	fmt.Println(GradCheck(FlashAttention(window, bias), q, k, v))
+
+	// Output: <nil>
+}
+
+func ExampleGradCheck_wrongBackward() {
+	a := M{{1, 2}}.Var()
+	double := func(x ...*variable.Variable) *variable.Variable {
+		return (&variable.Function{Forwarder: &wrongDoubleT{}}).First(x...)
+	}
+
+	fmt.Println(GradCheck(double, a))
+
+	// Output: input 0 [1 2], element 0: backward gradient 0.352911, numerical gradient 0.705823
+}
+
+// Doubles the input, but forgets to double the gradient.
+type wrongDoubleT struct{}
+
+func (f *wrongDoubleT) Forward(x ...*variable.Variable) []*variable.Variable {
+	return []*variable.Variable{variable.MulC(2, x[0])}
+}
+
+func (f *wrongDoubleT) Backward(gy ...*variable.Variable) []*variable.Variable {
+	return gy
+}
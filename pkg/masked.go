@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"math"
+
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+// Masked fills the elements of x not allowed by the mask with -Inf, so Softmax turns them into zeros.
+// Unlike MaskedInfFill the mask is a function, so no mask matrices are built for every call.
+func Masked(allowed func(row, col int) bool) func(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &MaskedT{Allowed: allowed}}).First
+}
+
+type MaskedT struct {
+	Allowed func(row, col int) bool
+}
+
+func (f *MaskedT) Forward(x ...*variable.Variable) []*variable.Variable {
+	return []*variable.Variable{
+		variable.NewFrom(f.mask(x[0].Data, math.Inf(-1))),
+	}
+}
+
+// Masked elements don't depend on x.
+func (f *MaskedT) Backward(gy ...*variable.Variable) []*variable.Variable {
+	return []*variable.Variable{
+		variable.NewFrom(f.mask(gy[0].Data, 0)),
+	}
+}
+
+func (f *MaskedT) mask(m *matrix.Matrix, fill float64) *matrix.Matrix {
+	out := matrix.ZeroLike(m)
+	for i := range m.Rows {
+		for j := range m.Cols {
+			if f.Allowed(i, j) {
+				out.Set(i, j, m.At(i, j))
+			} else {
+				out.Set(i, j, fill)
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,23 @@
+package pkg
+
+import "fmt"
+
+func ExampleMasked() {
+	a := M{
+		{1, 2, 3},
+		{4, 5, 6},
+	}.Var()
+
+	causal := func(row, col int) bool {
+		return col <= row
+	}
+	y := Masked(causal)(a)
+	fmt.Println(y.Data)
+
+	y.Backward()
+	fmt.Println(a.Grad.Data)
+
+	// Output:
+	// [[1 -Inf -Inf] [4 5 -Inf]]
+	// [[1 0 0] [1 1 0]]
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics of a single training step.
+type Metrics struct {
+	Step         int
+	Loss         float64       // training loss of this step
+	ValLoss      float64       // validation loss, NaN if the model wasn't evaluated at this step
+	LearningRate float64       // learning rate used for the update
+	GradNorm     float64       // L2 norm of all the gradients
+	TokensPerSec float64       // training throughput
+	Time         time.Duration // wall time since the start of the training
+}
+
+// Evaluated reports whether the validation loss was measured at this step.
+func (m Metrics) Evaluated() bool {
+	return !math.IsNaN(m.ValLoss)
+}
+
+// Sink receives metrics of every training step.
+type Sink interface {
+	Log(m Metrics)
+	Close()
+}
+
+// Sinks sends metrics to every sink.
+type Sinks []Sink
+
+func (s Sinks) Log(m Metrics) {
+	for _, sink := range s {
+		sink.Log(m)
+	}
+}
+
+func (s Sinks) Close() {
+	for _, sink := range s {
+		sink.Close()
+	}
+}
+
+// TerminalSink prints a progress bar and the average loss once per every evaluation.
+type TerminalSink struct {
+	EvalSteps int // length of the progress bar in steps, no progress bar if not positive
+	w         io.Writer
+	losses    float64
+	numLosses int
+	lastTime  time.Duration
+}
+
+func NewTerminalSink(w io.Writer, evalSteps int) *TerminalSink {
+	return &TerminalSink{EvalSteps: evalSteps, w: w}
+}
+
+func (s *TerminalSink) Log(m Metrics) {
+	s.losses += m.Loss
+	s.numLosses++
+	if !m.Evaluated() {
+		if s.EvalSteps < 1 {
+			return
+		}
+		fmt.Fprintf(s.w, "\r%s", strings.Repeat("·", (m.Step%s.EvalSteps)*26/s.EvalSteps)) // progress bar
+		return
+	}
+
+	// We average the loss over the steps since the last evaluation to smooth out fluctuations.
+	avgLoss := s.losses / float64(s.numLosses)
+	fmt.Fprintf(s.w, "\rstep: %5d, loss: %.4f, val loss: %.4f, time: %s\n", m.Step, avgLoss, m.ValLoss, m.Time-s.lastTime)
+	s.losses, s.numLosses, s.lastTime = 0, 0, m.Time
+}
+
+func (s *TerminalSink) Close() {
+	fmt.Fprint(s.w, "\r")
+}
+
+// JSONLSink writes metrics as one JSON object per line.
+type JSONLSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func NewJSONLSink(w io.WriteCloser) *JSONLSink {
+	return &JSONLSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *JSONLSink) Log(m Metrics) {
+	record := struct {
+		Step         int       `json:"step"`
+		Loss         jsonFloat `json:"loss"`
+		ValLoss      jsonFloat `json:"val_loss"`
+		LearningRate jsonFloat `json:"lr"`
+		GradNorm     jsonFloat `json:"grad_norm"`
+		TokensPerSec jsonFloat `json:"tokens_per_sec"`
+		Time         jsonFloat `json:"time"`
+	}{
+		Step:         m.Step,
+		Loss:         jsonFloat(m.Loss),
+		ValLoss:      jsonFloat(m.ValLoss),
+		LearningRate: jsonFloat(m.LearningRate),
+		GradNorm:     jsonFloat(m.GradNorm),
+		TokensPerSec: jsonFloat(m.TokensPerSec),
+		Time:         jsonFloat(m.Time.Seconds()),
+	}
+
+	if err := s.enc.Encode(record); err != nil {
+		panic(err)
+	}
+}
+
+func (s *JSONLSink) Close() {
+	if err := s.w.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// CSVSink writes metrics as CSV rows, missing values are left empty.
+type CSVSink struct {
+	w   io.WriteCloser
+	csv *csv.Writer
+}
+
+func NewCSVSink(w io.WriteCloser) *CSVSink {
+	s := &CSVSink{w: w, csv: csv.NewWriter(w)}
+	s.write("step", "loss", "val_loss", "lr", "grad_norm", "tokens_per_sec", "time")
+
+	return s
+}
+
+func (s *CSVSink) Log(m Metrics) {
+	s.write(
+		strconv.Itoa(m.Step),
+		formatFloat(m.Loss),
+		formatFloat(m.ValLoss),
+		formatFloat(m.LearningRate),
+		formatFloat(m.GradNorm),
+		formatFloat(m.TokensPerSec),
+		formatFloat(m.Time.Seconds()),
+	)
+}
+
+func (s *CSVSink) Close() {
+	s.csv.Flush()
+	if err := s.csv.Error(); err != nil {
+		panic(err)
+	}
+	if err := s.w.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func (s *CSVSink) write(record ...string) {
+	if err := s.csv.Write(record); err != nil {
+		panic(err)
+	}
+}
+
+// JSON has no NaN and Inf, so they are written as null.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return []byte("null"), nil
+	}
+
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
+
+func formatFloat(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
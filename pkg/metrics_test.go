@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+func ExampleJSONLSink() {
+	sink := NewJSONLSink(nopCloser{os.Stdout})
+	sink.Log(Metrics{Step: 0, Loss: 8.5, ValLoss: 8.25, LearningRate: 0.001, GradNorm: 2, TokensPerSec: 640, Time: time.Second})
+	sink.Log(Metrics{Step: 1, Loss: math.Inf(1), ValLoss: math.NaN(), LearningRate: 0.001, GradNorm: 3, TokensPerSec: 320, Time: 2 * time.Second})
+	sink.Close()
+
+	// Output:
+	// {"step":0,"loss":8.5,"val_loss":8.25,"lr":0.001,"grad_norm":2,"tokens_per_sec":640,"time":1}
+	// {"step":1,"loss":null,"val_loss":null,"lr":0.001,"grad_norm":3,"tokens_per_sec":320,"time":2}
+}
+
+func ExampleCSVSink() {
+	sink := NewCSVSink(nopCloser{os.Stdout})
+	sink.Log(Metrics{Step: 0, Loss: 8.5, ValLoss: 8.25, LearningRate: 0.001, GradNorm: 2, TokensPerSec: 640, Time: time.Second})
+	sink.Log(Metrics{Step: 1, Loss: 8, ValLoss: math.NaN(), LearningRate: 0.001, GradNorm: 3, TokensPerSec: 320, Time: 2 * time.Second})
+	sink.Close()
+
+	// Output:
+	// step,loss,val_loss,lr,grad_norm,tokens_per_sec,time
+	// 0,8.5,8.25,0.001,2,640,1
+	// 1,8,,0.001,3,320,2
+}
+
+func ExampleTerminalSink() {
+	var out strings.Builder
+	sink := NewTerminalSink(nopCloser{&out}, 2)
+	sink.Log(Metrics{Step: 0, Loss: 8, ValLoss: 7, Time: time.Second})
+	sink.Log(Metrics{Step: 1, Loss: 6, ValLoss: math.NaN(), Time: 2 * time.Second})
+	sink.Log(Metrics{Step: 2, Loss: 4, ValLoss: 5, Time: 3 * time.Second})
+
+	for _, line := range strings.Split(out.String(), "\r") {
+		fmt.Printf("%q\n", line)
+	}
+
+	// Output:
+	// ""
+	// "step:     0, loss: 8.0000, val loss: 7.0000, time: 1s\n"
+	// "·············"
+	// "step:     2, loss: 5.0000, val loss: 5.0000, time: 2s\n"
+}
+
+func ExampleTerminalSink_noEvalSteps() {
+	var out strings.Builder
+	sink := NewTerminalSink(nopCloser{&out}, 0)
+	sink.Log(Metrics{Step: 0, Loss: 8, ValLoss: math.NaN(), Time: time.Second})
+	sink.Log(Metrics{Step: 1, Loss: 6, ValLoss: 5, Time: 2 * time.Second})
+
+	fmt.Printf("%q\n", out.String())
+
+	// Output:
+	// "\rstep:     1, loss: 7.0000, val loss: 5.0000, time: 2s\n"
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
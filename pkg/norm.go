@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"math"
+
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+// LayerNorm normalizes every row of x to mean 0 and variance 1, then scales and shifts it:
+// LayerNorm(eps)(x, scale, shift). Forward and backward are computed at once
+// instead of building a graph of Mean, Variance, Sub, Div and Pow.
+func LayerNorm(eps float64) func(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &NormT{Eps: eps, Center: true}}).First
+}
+
+// RMSNorm divides every row of x by its root mean square, then scales it: RMSNorm(eps)(x, scale).
+// Unlike LayerNorm it doesn't center the rows and has no shift, so it's cheaper.
+func RMSNorm(eps float64) func(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &NormT{Eps: eps}}).First
+}
+
+type NormT struct {
+	Eps    float64
+	Center bool           // subtract the mean of the row, LayerNorm
+	xhat   *matrix.Matrix // normalized x
+	std    []float64      // per row
+	scale  *variable.Variable
+	shift  bool // x, scale and shift are given, not just x and scale
+}
+
+func (f *NormT) Forward(x ...*variable.Variable) []*variable.Variable {
+	in := x[0].Data
+	f.scale = x[1]
+	f.xhat = matrix.ZeroLike(in)
+	f.std = make([]float64, in.Rows)
+	for i := range in.Rows {
+		row := in.Row(i)
+		rowMean := 0.0
+		if f.Center {
+			rowMean = mean(row)
+		}
+
+		var sumSq float64
+		for _, v := range row {
+			sumSq += (v - rowMean) * (v - rowMean)
+		}
+		f.std[i] = math.Sqrt(sumSq/float64(len(row)) + f.Eps)
+
+		for j, v := range row {
+			f.xhat.Set(i, j, (v-rowMean)/f.std[i])
+		}
+	}
+
+	y := matrix.F2(f.xhat, f.scale.Data, func(a, b float64) float64 { return a * b })
+	f.shift = len(x) > 2
+	if f.shift {
+		y = matrix.Add(y, x[2].Data)
+	}
+
+	return []*variable.Variable{variable.NewFrom(y)}
+}
+
+// With g = gy*scale: dx = (g - mean(g) - xhat*mean(g*xhat)) / std,
+// the mean(g) term is only there if the mean was subtracted.
+func (f *NormT) Backward(gy ...*variable.Variable) []*variable.Variable {
+	rows, cols := f.xhat.Rows, f.xhat.Cols
+	gx := matrix.Zero(rows, cols)
+	gScale := matrix.Zero(1, cols)
+	gShift := matrix.Zero(1, cols)
+	for i := range rows {
+		g := make([]float64, cols)
+		var gMean, gxhatMean float64
+		for j := range cols {
+			gyij := gy[0].Data.At(i, j)
+			gScale.Data[j] += gyij * f.xhat.At(i, j)
+			gShift.Data[j] += gyij
+
+			g[j] = gyij * f.scale.Data.Data[j]
+			gMean += g[j] / float64(cols)
+			gxhatMean += g[j] * f.xhat.At(i, j) / float64(cols)
+		}
+		if !f.Center {
+			gMean = 0
+		}
+
+		for j := range cols {
+			gx.Set(i, j, (g[j]-gMean-f.xhat.At(i, j)*gxhatMean)/f.std[i])
+		}
+	}
+
+	grads := []*variable.Variable{variable.NewFrom(gx), variable.NewFrom(gScale)}
+	if f.shift {
+		grads = append(grads, variable.NewFrom(gShift))
+	}
+
+	return grads
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+)
+
+func ExampleLayerNorm() {
+	x := M{
+		{1, 2, 3},
+		{-2, 0, 2},
+	}.Var()
+	scale := M{{1, 1, 2}}.Var()
+	shift := M{{0, 10, 0}}.Var()
+
+	y := LayerNorm(0)(x, scale, shift)
+	for _, row := range y.Data.Seq2() {
+		fmt.Printf("%.4f\n", row)
+	}
+
+	// Output:
+	// [-1.2247 10.0000 2.4495]
+	// [-1.2247 10.0000 2.4495]
+}
+
+func ExampleRMSNorm() {
+	x := M{{3, -4}}.Var() // root mean square is sqrt((9+16)/2)
+	scale := M{{1, 2}}.Var()
+
+	y := RMSNorm(0)(x, scale)
+	fmt.Printf("%.4f\n", y.Data.Row(0))
+	fmt.Printf("%.4f\n", []float64{3 / math.Sqrt(12.5), -8 / math.Sqrt(12.5)})
+
+	// Output:
+	// [0.8485 -2.2627]
+	// [0.8485 -2.2627]
+}
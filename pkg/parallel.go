@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"sync"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+// DataParallel trains replicas of a model on different samples in separate goroutines.
+// Replicas share the weights with the master params, but have their own variables,
+// so their gradients don't race with each other. Gradients are averaged into the
+// master params, so a single optimizer step updates the weights for all the replicas.
+type DataParallel struct {
+	master   *Params
+	replicas []*Params
+}
+
+// NewDataParallel expects at least one replica, every replica has its params added in the same order as master.
+func NewDataParallel(master *Params, replicas ...*Params) *DataParallel {
+	if len(replicas) == 0 {
+		panic("no replicas to train")
+	}
+	for _, replica := range replicas {
+		if len(replica.params) != len(master.params) {
+			panic("replica params mismatch master params")
+		}
+	}
+
+	return &DataParallel{master: master, replicas: replicas}
+}
+
+// Step calls forward for every replica in parallel, forward should return the loss.
+// The losses are backpropagated in parallel too. Returns the mean loss of the replicas.
+func (dp *DataParallel) Step(forward func(replica int) *variable.Variable) float64 {
+	dp.sync()
+
+	losses := make([]*variable.Variable, len(dp.replicas))
+	dp.parallel(func(i int) {
+		losses[i] = forward(i)
+		if anomalyDetection {
+			if err := CheckForward(losses[i]); err != nil {
+				panic(err)
+			}
+		}
+	})
+
+	// Backward toggles the global backprop flag, which would break the graphs of
+	// other replicas still running forward. So all forwards are done at this point,
+	// and the flag is switched once for all the backwards.
+	span := variable.Nograd()
+	dp.parallel(func(i int) {
+		losses[i].Backward(variable.Opts{CreateGraph: true, RetainGrad: anomalyDetection})
+		if anomalyDetection {
+			if err := CheckBackward(losses[i]); err != nil {
+				panic(err)
+			}
+		}
+	})
+	span.End()
+
+	dp.allReduce()
+
+	var sum float64
+	for _, loss := range losses {
+		sum += Val(loss)
+	}
+
+	return sum / float64(len(losses))
+}
+
+// Runs f for every replica in its own goroutine.
+func (dp *DataParallel) parallel(f func(replica int)) {
+	var wg sync.WaitGroup
+	for i := range dp.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// Points the replicas to the latest master weights, optimizer replaces the weights on every update.
+func (dp *DataParallel) sync() {
+	for _, replica := range dp.replicas {
+		for key, param := range replica.params {
+			param.Data = dp.master.params[key].Data
+		}
+	}
+}
+
+// Sets master gradients to the mean of the replica gradients and clears the replica gradients.
+// Frozen master params get no gradient, so the optimizer skips them.
+func (dp *DataParallel) allReduce() {
+	scale := 1.0 / float64(len(dp.replicas))
+	for key, param := range dp.master.params {
+		if dp.master.IsFrozen(param) {
+			continue
+		}
+		var sum []float64
+		for _, replica := range dp.replicas {
+			grad := replica.params[key].Grad
+			if grad == nil {
+				continue
+			}
+			if sum == nil {
+				sum = make([]float64, len(grad.Data.Data))
+			}
+			for j, g := range grad.Data.Data {
+				sum[j] += g
+			}
+		}
+		if sum == nil {
+			continue
+		}
+
+		mean := variable.ZeroLike(param)
+		for j, g := range sum {
+			mean.Data.Data[j] = g * scale
+		}
+		param.Grad = mean
+	}
+
+	for _, replica := range dp.replicas {
+		replica.ZeroGrad()
+	}
+}
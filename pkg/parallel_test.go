@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleDataParallel() {
+	weight := M{{1}, {1}}.Var()
+	master := NewParams()
+	master.Add(weight)
+
+	var replicas []*Params
+	var weights []*variable.Variable
+	for range 2 {
+		w := M{{0}, {0}}.Var() // weights are synced with master before the step
+		replica := NewParams()
+		replica.Add(w)
+		replicas = append(replicas, replica)
+		weights = append(weights, w)
+	}
+
+	// Every replica sees its own sample.
+	inputs := []*variable.Variable{V{1, 2}.Var(), V{3, 4}.Var()}
+	dp := NewDataParallel(master, replicas...)
+	loss := dp.Step(func(i int) *variable.Variable {
+		return MatMul(inputs[i], weights[i])
+	})
+
+	fmt.Println(loss)
+	fmt.Println(weight.Grad.Data)
+	fmt.Println(weights[0].Grad, weights[1].Grad)
+
+	// Output:
+	// 5
+	// [[2] [3]]
+	// <nil> <nil>
+}
+
+func ExampleNewDataParallel_noReplicas() {
+	master := NewParams()
+	master.Add(variable.New(1))
+
+	defer func() {
+		fmt.Println(recover())
+	}()
+	NewDataParallel(master)
+
+	// Output: no replicas to train
+}
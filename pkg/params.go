@@ -4,17 +4,48 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"iter"
+	"math"
 	"os"
 
 	"github.com/itsubaki/autograd/layer"
+	"github.com/itsubaki/autograd/variable"
 )
 
 type Params struct {
 	params layer.Parameters
+	prefix string   // of the file names
+	names  []string // of the params in the order of adding, see SetNames
+	frozen map[*variable.Variable]bool
 }
 
 func NewParams() *Params {
-	return &Params{params: layer.Parameters{}}
+	return &Params{params: layer.Parameters{}, prefix: "model", frozen: make(map[*variable.Variable]bool)}
+}
+
+// Named sets the prefix of the file names, "model" by default, e.g. for the params of adapters.
+func (p *Params) Named(prefix string) *Params {
+	p.prefix = prefix
+	return p
+}
+
+// SetNames names the params in the order they were added, e.g. "blocks.0.mlp.weight", see Freeze.
+// Files don't store the names, checkpoints are the same with or without them.
+func (p *Params) SetNames(names ...string) {
+	if len(names) != len(p.params) {
+		panic(fmt.Sprintf("%d names for %d params", len(names), len(p.params)))
+	}
+
+	p.names = names
+}
+
+// Returns the name of the i-th param, its index if the params aren't named.
+func (p *Params) name(i int) string {
+	if p.names == nil {
+		return fmt.Sprintf("%d", i)
+	}
+
+	return p.names[i]
 }
 
 func (p *Params) Add(params ...layer.Parameter) {
@@ -27,6 +58,17 @@ func (p *Params) Params() layer.Parameters {
 	return p.params
 }
 
+// ByName iterates over the params in the order of adding, with their names, see SetNames.
+func (p *Params) ByName() iter.Seq2[string, layer.Parameter] {
+	return func(yield func(string, layer.Parameter) bool) {
+		for i := range len(p.params) {
+			if !yield(p.name(i), p.params[fmt.Sprintf("%d", i)]) {
+				return
+			}
+		}
+	}
+}
+
 func (p *Params) Count() int {
 	numParams := 0
 	for _, param := range p.params {
@@ -36,12 +78,46 @@ func (p *Params) Count() int {
 	return numParams
 }
 
+// GradNorm returns the L2 norm of the gradients of all the params, except the frozen ones.
+func (p *Params) GradNorm() float64 {
+	var sum float64
+	for _, param := range p.params {
+		if param.Grad == nil || p.frozen[param] {
+			continue
+		}
+		for _, g := range param.Grad.Data.Data {
+			sum += g * g
+		}
+	}
+
+	return math.Sqrt(sum)
+}
+
+// IsFinite reports whether all the params are free of NaN and Inf values.
+func (p *Params) IsFinite() bool {
+	for _, param := range p.params {
+		if !IsFinite(param.Data.Data...) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (p *Params) ZeroGrad() {
 	p.params.Cleargrads()
 }
 
 func (p *Params) Save() {
-	file, err := os.Create(p.filename())
+	p.SaveAs(p.Filename())
+}
+
+func (p *Params) SaveAs(filename string) {
+	if !p.IsFinite() {
+		panic(fmt.Sprintf("params have NaN or Inf values, refusing to save '%s'", filename))
+	}
+
+	file, err := os.Create(filename)
 	if err != nil {
 		panic(err)
 	}
@@ -68,10 +144,24 @@ func (p *Params) Save() {
 }
 
 func (p *Params) TryLoadPretrained() {
-	file, err := os.Open(p.filename())
-	if err != nil {
+	if _, err := os.Stat(p.Filename()); err != nil {
 		return
 	}
+
+	p.Load()
+	fmt.Printf("Loaded pretrained params: %s\n", p.Filename())
+}
+
+// Load overwrites the params with the previously saved ones.
+func (p *Params) Load() {
+	p.LoadFrom(p.Filename())
+}
+
+func (p *Params) LoadFrom(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
 	defer file.Close()
 
 	// Load map of params in ordered fashion.
@@ -80,7 +170,7 @@ func (p *Params) TryLoadPretrained() {
 		key := fmt.Sprintf("%d", i)
 		for _, row := range p.params[key].Data.Seq2() {
 			if err := binary.Read(file, binary.LittleEndian, &row); err != nil {
-				panic(fmt.Sprintf("model shapes mismatch, remove '%s' file", p.filename()))
+				panic(shapesMismatch(filename))
 			}
 		}
 		shape := fmt.Sprintf("%d:%d×%d", i, p.params[key].Data.Rows, p.params[key].Data.Cols)
@@ -92,12 +182,18 @@ func (p *Params) TryLoadPretrained() {
 		panic(fmt.Errorf("failed to read shapes checksum: %v", err))
 	}
 	if savedChecksum != hash.Sum32() {
-		panic(fmt.Sprintf("model shapes mismatch, remove '%s' file", p.filename()))
+		panic(shapesMismatch(filename))
 	}
+}
 
-	fmt.Printf("Loaded pretrained params: %s\n", p.filename())
+// Checkpoints saved with a Query, Key and Value per attention head have different shapes,
+// but they are converted by the convert command instead of being retrained.
+func shapesMismatch(filename string) string {
+	return fmt.Sprintf("model shapes mismatch in '%s' file: if it was saved with per-head attention weights, "+
+		"convert it with 'go run . convert -in %s' and run it with {\"residual\": \"legacy\"}, remove it otherwise", filename, filename)
 }
 
-func (p *Params) filename() string {
-	return fmt.Sprintf("model-%.3fM", Millions(p.Count()))
+// Filename returns the default file name of the params, e.g. "model-0.512M".
+func (p *Params) Filename() string {
+	return fmt.Sprintf("%s-%.3fM", p.prefix, Millions(p.Count()))
 }
@@ -0,0 +1,22 @@
+package pkg
+
+import "fmt"
+
+func ExampleParams_ByName() {
+	params := NewParams()
+	params.Add(M{{1, 2}}.Var(), M{{3}}.Var())
+	for name, param := range params.ByName() {
+		fmt.Println(name, param.Data.Data)
+	}
+
+	params.SetNames("tok_embeds", "blocks.0.mlp.weight")
+	for name, param := range params.ByName() {
+		fmt.Println(name, param.Data.Data)
+	}
+
+	// Output:
+	// 0 [1 2]
+	// 1 [3]
+	// tok_embeds [1 2]
+	// blocks.0.mlp.weight [3]
+}
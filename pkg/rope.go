@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"math"
+
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+const ropeBase = 10000.0 // as in RoFormer, lower features rotate faster
+
+// RoPE applies rotary position embeddings to the rows of x, row i being the token at position offset+i.
+// Every pair of features (2k, 2k+1) is rotated by the angle position*ropeBase^(-2k/cols),
+// so the dot product of a rotated query and key depends only on the distance between their positions.
+// The last feature of an odd number of columns is left as is.
+//
+//	query = RoPE(past)(query)
+func RoPE(offset int) func(x ...*variable.Variable) *variable.Variable {
+	return (&variable.Function{Forwarder: &RoPET{Offset: offset}}).First
+}
+
+type RoPET struct {
+	Offset  int
+	Inverse bool // rotate in the opposite direction, used by Backward
+}
+
+func (f *RoPET) Forward(x ...*variable.Variable) []*variable.Variable {
+	return []*variable.Variable{
+		variable.NewFrom(rotate(x[0].Data, f.Offset, f.Inverse)),
+	}
+}
+
+// Rotation is orthogonal, so the gradient is rotated back by the same angle.
+func (f *RoPET) Backward(gy ...*variable.Variable) []*variable.Variable {
+	return []*variable.Variable{
+		(&variable.Function{Forwarder: &RoPET{Offset: f.Offset, Inverse: !f.Inverse}}).First(gy[0]),
+	}
+}
+
+func rotate(x *matrix.Matrix, offset int, inverse bool) *matrix.Matrix {
+	out := matrix.ZeroLike(x)
+	copy(out.Data, x.Data)
+	for i := range x.Rows {
+		pos := float64(offset + i)
+		for k := 0; k+1 < x.Cols; k += 2 {
+			angle := pos * math.Pow(ropeBase, -float64(k)/float64(x.Cols))
+			if inverse {
+				angle = -angle
+			}
+
+			sin, cos := math.Sincos(angle)
+			x0, x1 := x.At(i, k), x.At(i, k+1)
+			out.Set(i, k, x0*cos-x1*sin)
+			out.Set(i, k+1, x0*sin+x1*cos)
+		}
+	}
+
+	return out
+}
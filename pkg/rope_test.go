@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleRoPE() {
+	x := M{
+		{1, 0, 1, 0},
+		{1, 0, 1, 0},
+	}.Var()
+
+	// The first pair of the second row is rotated by 1 radian, the second one by 1/100.
+	y := RoPE(0)(x)
+	for _, row := range y.Data.Seq2() {
+		fmt.Printf("%.4f\n", row)
+	}
+
+	// Output:
+	// [1.0000 0.0000 1.0000 0.0000]
+	// [0.5403 0.8415 1.0000 0.0100]
+}
+
+func ExampleRoPE_relative() {
+	q := M{{0.3, -1.2, 0.5, 0.7}}.Var()
+	k := M{{0.9, 0.4, -0.2, 1.1}}.Var()
+
+	// The score of a query and a key depends only on the distance between them.
+	dot := func(qPos, kPos int) float64 {
+		return Val(MatMul(RoPE(qPos)(q), variable.Transpose(RoPE(kPos)(k))))
+	}
+
+	fmt.Println(math.Abs(dot(5, 2)-dot(13, 10)) < 1e-12)
+
+	// Output: true
+}
+
+func ExampleRoPE_backward() {
+	x := M{{1, 2, 3}}.Var()
+	y := RoPE(3)(x)
+	y.Backward()
+
+	// The last feature of an odd number of columns isn't rotated.
+	fmt.Printf("%.4f %.4f\n", y.Data.At(0, 2), x.Grad.Data.At(0, 2))
+
+	// Output: 3.0000 1.0000
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/itsubaki/autograd/matrix"
+	"github.com/itsubaki/autograd/variable"
+)
+
+// Split splits the columns of x into n equal parts, the reverse of Cat.
+// It's a single function in the graph, however many parts are used.
+func Split(x *variable.Variable, n int) []*variable.Variable {
+	parts := (&variable.Function{Forwarder: &SplitT{NumOutputs: n}}).Forward(x)
+
+	// The function keeps the parts as its outputs for backward, replacing
+	// a part in the returned slice mustn't replace the output.
+	return slices.Clone(parts)
+}
+
+type SplitT struct {
+	NumOutputs int
+	Rows, Cols int // shape of the input
+}
+
+func (f *SplitT) Forward(x ...*variable.Variable) []*variable.Variable {
+	f.Rows, f.Cols = x[0].Data.Rows, x[0].Data.Cols
+	if f.Cols%f.NumOutputs != 0 {
+		panic(fmt.Sprintf("can't split %d columns into %d equal parts", f.Cols, f.NumOutputs))
+	}
+
+	size := f.Cols / f.NumOutputs
+	parts := make([]*variable.Variable, f.NumOutputs)
+	for i := range parts {
+		part := matrix.Zero(f.Rows, size)
+		for r := range f.Rows {
+			copy(part.Row(r), x[0].Data.Row(r)[i*size:(i+1)*size])
+		}
+		parts[i] = variable.NewFrom(part)
+	}
+
+	return parts
+}
+
+// Parts that weren't used have no gradient, their columns get zeros.
+func (f *SplitT) Backward(gy ...*variable.Variable) []*variable.Variable {
+	size := f.Cols / f.NumOutputs
+	gx := matrix.Zero(f.Rows, f.Cols)
+	for i, g := range gy {
+		if g == nil {
+			continue
+		}
+		for r := range f.Rows {
+			copy(gx.Row(r)[i*size:], g.Data.Row(r))
+		}
+	}
+
+	return []*variable.Variable{variable.NewFrom(gx)}
+}
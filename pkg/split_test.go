@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/itsubaki/autograd/variable"
+)
+
+func ExampleSplit() {
+	a := M{
+		{1, 2, 3, 4, 5, 6},
+		{7, 8, 9, 10, 11, 12},
+	}.Var()
+
+	for _, part := range Split(a, 3) {
+		fmt.Println(part.Data)
+	}
+
+	// Output:
+	// [[1 2] [7 8]]
+	// [[3 4] [9 10]]
+	// [[5 6] [11 12]]
+}
+
+func ExampleSplit_gradient() {
+	a := M{
+		{1, 2, 3, 4},
+		{5, 6, 7, 8},
+	}.Var()
+
+	// The second part isn't used.
+	parts := Split(a, 2)
+	y := MatMul(parts[0], M{{1}, {2}}.Var())
+	y.Backward()
+
+	fmt.Println(a.Grad.Data)
+
+	// Output: [[1 2 0 0] [1 2 0 0]]
+}
+
+func ExampleSplit_replacedPart() {
+	a := M{{1, 2}}.Var()
+
+	parts := Split(a, 2)
+	parts[1] = variable.MulC(3, parts[1])
+	y := Cat(parts...)
+	y.Backward()
+
+	fmt.Println(a.Grad.Data)
+
+	// Output: [[1 3]]
+}
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const histogramBuckets = 30
+
+// TensorBoard writes scalars, histograms and texts to a tfevents file, which can be viewed with:
+//
+//	tensorboard --logdir <dir>
+//
+// Events are protobuf messages wrapped into TFRecords, both are encoded by hand to avoid dependencies.
+type TensorBoard struct {
+	file *os.File
+}
+
+func NewTensorBoard(dir string) *TensorBoard {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		panic(err)
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("events.out.tfevents.%d.%s", time.Now().Unix(), host)
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		panic(err)
+	}
+
+	tb := &TensorBoard{file: file}
+	tb.write(event(0).bytes(3, []byte("brain.Event:2"))) // file_version
+
+	return tb
+}
+
+// Log writes the training metrics as scalars, so TensorBoard can be used as a metrics sink.
+func (tb *TensorBoard) Log(m Metrics) {
+	tb.Scalar("loss/train", m.Step, m.Loss)
+	if m.Evaluated() {
+		tb.Scalar("loss/val", m.Step, m.ValLoss)
+	}
+	tb.Scalar("lr", m.Step, m.LearningRate)
+	tb.Scalar("grad_norm", m.Step, m.GradNorm)
+	tb.Scalar("tokens_per_sec", m.Step, m.TokensPerSec)
+}
+
+func (tb *TensorBoard) Scalar(tag string, step int, value float64) {
+	v := proto{}.bytes(1, []byte(tag)).float(2, float32(value)) // tag, simple_value
+	tb.writeSummary(step, v)
+}
+
+// Histogram writes the distribution of values, e.g. weights or gradients of a param.
+// NaN and Inf values don't fit into the buckets, their number is written as the "<tag>/non_finite" scalar.
+func (tb *TensorBoard) Histogram(tag string, step int, values []float64) {
+	finite := slices.DeleteFunc(slices.Clone(values), func(v float64) bool {
+		return math.IsNaN(v) || math.IsInf(v, 0)
+	})
+	if nonFinite := len(values) - len(finite); nonFinite > 0 {
+		tb.Scalar(tag+"/non_finite", step, float64(nonFinite))
+	}
+	values = finite
+	if len(values) == 0 {
+		return
+	}
+
+	lo, hi := slices.Min(values), slices.Max(values)
+	var sum, sumSquares float64
+	for _, v := range values {
+		sum += v
+		sumSquares += v * v
+	}
+
+	// Buckets of equal width between min and max, limits are the right edges of the buckets.
+	width := (hi - lo) / histogramBuckets
+	limits := make([]float64, histogramBuckets)
+	counts := make([]float64, histogramBuckets)
+	for i := range limits {
+		limits[i] = lo + width*float64(i+1)
+	}
+	limits[len(limits)-1] = hi
+	for _, v := range values {
+		i := histogramBuckets - 1
+		if width > 0 {
+			i = min(int((v-lo)/width), histogramBuckets-1)
+		}
+		counts[i]++
+	}
+
+	histo := proto{}.
+		double(1, lo).                   // min
+		double(2, hi).                   // max
+		double(3, float64(len(values))). // num
+		double(4, sum).                  // sum
+		double(5, sumSquares).           // sum_squares
+		doubles(6, limits).              // bucket_limit
+		doubles(7, counts)               // bucket
+	v := proto{}.bytes(1, []byte(tag)).bytes(5, histo) // tag, histo
+	tb.writeSummary(step, v)
+}
+
+// Text writes a text, e.g. a sample generated by the model.
+func (tb *TensorBoard) Text(tag string, step int, text string) {
+	pluginData := proto{}.bytes(1, []byte("text")) // plugin_name
+	metadata := proto{}.bytes(1, pluginData)       // plugin_data
+	tensor := proto{}.
+		varint(1, 7).          // dtype = DT_STRING
+		bytes(2, proto{}).     // tensor_shape, scalar
+		bytes(8, []byte(text)) // string_val
+	v := proto{}.bytes(1, []byte(tag)).bytes(8, tensor).bytes(9, metadata) // tag, tensor, metadata
+	tb.writeSummary(step, v)
+}
+
+func (tb *TensorBoard) Close() {
+	if err := tb.file.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func (tb *TensorBoard) writeSummary(step int, value proto) {
+	summary := proto{}.bytes(1, value) // value
+	tb.write(event(step).bytes(5, summary))
+}
+
+// Writes a TFRecord: length, masked crc of length, data, masked crc of data.
+func (tb *TensorBoard) write(data []byte) {
+	header := binary.LittleEndian.AppendUint64(nil, uint64(len(data)))
+	record := binary.LittleEndian.AppendUint32(header, maskedCRC(header))
+	record = append(record, data...)
+	record = binary.LittleEndian.AppendUint32(record, maskedCRC(data))
+
+	if _, err := tb.file.Write(record); err != nil {
+		panic(err)
+	}
+}
+
+// Returns an event with wall_time and step fields set.
+func event(step int) proto {
+	wallTime := float64(time.Now().UnixNano()) / 1e9
+	return proto{}.double(1, wallTime).varint(2, uint64(step))
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func maskedCRC(data []byte) uint32 {
+	crc := crc32.Checksum(data, crc32c)
+	return ((crc >> 15) | (crc << 17)) + 0xa282ead8
+}
+
+// Minimal protobuf encoder, every method appends a field with the given number.
+type proto []byte
+
+func (p proto) varint(field int, v uint64) proto {
+	p = binary.AppendUvarint(p, uint64(field<<3|0))
+	return binary.AppendUvarint(p, v)
+}
+
+func (p proto) double(field int, v float64) proto {
+	p = binary.AppendUvarint(p, uint64(field<<3|1))
+	return binary.LittleEndian.AppendUint64(p, math.Float64bits(v))
+}
+
+func (p proto) float(field int, v float32) proto {
+	p = binary.AppendUvarint(p, uint64(field<<3|5))
+	return binary.LittleEndian.AppendUint32(p, math.Float32bits(v))
+}
+
+func (p proto) bytes(field int, v []byte) proto {
+	p = binary.AppendUvarint(p, uint64(field<<3|2))
+	p = binary.AppendUvarint(p, uint64(len(v)))
+	return append(p, v...)
+}
+
+// Packed repeated doubles.
+func (p proto) doubles(field int, v []float64) proto {
+	var packed []byte
+	for _, d := range v {
+		packed = binary.LittleEndian.AppendUint64(packed, math.Float64bits(d))
+	}
+
+	return p.bytes(field, packed)
+}
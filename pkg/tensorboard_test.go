@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+func ExampleTensorBoard() {
+	dir, _ := os.MkdirTemp("", "tensorboard")
+	defer os.RemoveAll(dir)
+
+	tb := NewTensorBoard(dir)
+	tb.Scalar("loss/train", 1, 4.2)
+	tb.Histogram("weights/0", 1, []float64{-1, 0, 0.5, 1})
+	tb.Text("sample", 1, "mysterious island")
+	tb.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "events.out.tfevents.*"))
+	content, _ := os.ReadFile(files[0])
+	for len(content) > 0 {
+		// TFRecord: length, masked crc of length, data, masked crc of data.
+		header := content[:8]
+		length := binary.LittleEndian.Uint64(header)
+		event := content[12 : 12+length]
+		validHeader := binary.LittleEndian.Uint32(content[8:12]) == maskedCRC(header)
+		validData := binary.LittleEndian.Uint32(content[12+length:]) == maskedCRC(event)
+		content = content[16+length:]
+
+		for _, tag := range []string{"brain.Event:2", "loss/train", "weights/0", "sample"} {
+			if bytes.Contains(event, []byte(tag)) {
+				fmt.Println(tag, validHeader, validData)
+			}
+		}
+	}
+
+	// Output:
+	// brain.Event:2 true true
+	// loss/train true true
+	// weights/0 true true
+	// sample true true
+}
+
+func ExampleTensorBoard_Histogram_nonFinite() {
+	dir, _ := os.MkdirTemp("", "tensorboard")
+	defer os.RemoveAll(dir)
+
+	tb := NewTensorBoard(dir)
+	tb.Histogram("grads/0", 1, []float64{1, math.NaN(), math.Inf(1), 2})
+	tb.Histogram("grads/1", 1, []float64{math.NaN()})
+	tb.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "events.out.tfevents.*"))
+	content, _ := os.ReadFile(files[0])
+	for _, v := range []proto{
+		proto{}.bytes(1, []byte("grads/0/non_finite")).float(2, 2),
+		proto{}.bytes(1, []byte("grads/1/non_finite")).float(2, 1),
+		append(proto{}.bytes(1, []byte("grads/0")), 5<<3|2), // histo field follows the tag, of the finite values
+		append(proto{}.bytes(1, []byte("grads/1")), 5<<3|2), // no histo without finite values
+		proto{}.double(3, 2), // num of the finite values
+	} {
+		fmt.Println(bytes.Contains(content, v))
+	}
+
+	// Output:
+	// true
+	// true
+	// true
+	// false
+	// true
+}
+
+func Example_proto() {
+	// Scalar summary value: tag="a", simple_value=1.
+	v := proto{}.bytes(1, []byte("a")).float(2, 1)
+	fmt.Printf("% x\n", []byte(v))
+
+	// Output: 0a 01 61 15 00 00 80 3f
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+)
+
+// SweepSpec describes a hyperparameter search, keys are the JSON names of Config fields:
+//
+//	{
+//	  "method": "random",
+//	  "runs": 8,
+//	  "base": {"steps": 3000, "eval_steps": 500},
+//	  "params": {
+//	    "embed_size": [32, 64, 88],
+//	    "learning_rate": {"min": 0.00005, "max": 0.001, "log": true},
+//	    "dropout": {"min": 0, "max": 0.3}
+//	  }
+//	}
+//
+// Grid search tries every combination of the listed values, random search samples
+// "runs" configs, picking a value from a list or from a range. Ranges with integer
+// bounds produce integers, log ranges are sampled uniformly in the log space.
+type SweepSpec struct {
+	Method string                     `json:"method"` // grid or random
+	Runs   int                        `json:"runs"`   // number of runs for random search
+	Seed   uint64                     `json:"seed"`   // seed of random search
+	Base   map[string]any             `json:"base"`   // overrides shared by all the runs, e.g. short training
+	Params map[string]json.RawMessage `json:"params"` // list of values or a range for every swept field
+}
+
+type sweepRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Log bool    `json:"log"`
+}
+
+type sweepRun struct {
+	name     string
+	params   map[string]any
+	valLoss  float64 // best validation loss, NaN if the run failed or wasn't evaluated
+	bestStep int
+}
+
+// Runs short trainings for every config of the spec and writes a leaderboard:
+//
+//	go run . sweep -spec sweep.json -parallel 2
+//
+// Every run is a separate process with its own directory containing
+// config.json, train.log, metrics.jsonl and the checkpoints.
+func sweepCmd(args []string) {
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	specFile := flags.String("spec", "", "JSON file with the sweep specification, see SweepSpec")
+	dir := flags.String("dir", "sweep", "Directory to put the runs and the leaderboard to")
+	parallel := flags.Int("parallel", 1, "Number of runs trained at the same time")
+	flags.Parse(args)
+	if *specFile == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	spec := loadSweepSpec(*specFile)
+	base := applyParams(config, spec.Base)
+	var runs []*sweepRun
+	for i, params := range spec.configs() {
+		run := &sweepRun{name: fmt.Sprintf("run-%03d", i), params: params}
+		runDir := filepath.Join(*dir, run.name)
+		if err := os.MkdirAll(runDir, 0o755); err != nil {
+			panic(err)
+		}
+		// Invalid values fail here, before any training is started.
+		saveConfig(applyParams(base, params), filepath.Join(runDir, "config.json"))
+		runs = append(runs, run)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Sweeping %d configs, %d at a time\n", len(runs), *parallel)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(1, *parallel))
+	for _, run := range runs {
+		runDir := filepath.Join(*dir, run.name)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fmt.Printf("%s started: %v\n", run.name, run.params)
+			if err := train(exe, runDir); err != nil {
+				// A diverged or crashed run is a result too, the others keep going.
+				fmt.Printf("%s failed: %v, see %s\n", run.name, err, filepath.Join(runDir, "train.log"))
+			}
+			run.valLoss, run.bestStep = bestValLoss(filepath.Join(runDir, "metrics.jsonl"))
+			fmt.Printf("%s finished: val loss %.4f at step %d\n", run.name, run.valLoss, run.bestStep)
+		}()
+	}
+	wg.Wait()
+
+	writeLeaderboard(runs, spec.keys(), filepath.Join(*dir, "leaderboard.csv"))
+}
+
+func loadSweepSpec(filename string) SweepSpec {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	var spec SweepSpec
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		panic(fmt.Sprintf("invalid sweep spec '%s': %v", filename, err))
+	}
+
+	return spec
+}
+
+// Returns the params of every run of the sweep.
+func (s SweepSpec) configs() []map[string]any {
+	switch s.Method {
+	case "grid", "":
+		return s.grid()
+	case "random":
+		return s.random()
+	default:
+		panic(fmt.Sprintf("unknown sweep method '%s', want grid or random", s.Method))
+	}
+}
+
+// Returns every combination of the values, the last key changes the fastest.
+func (s SweepSpec) grid() []map[string]any {
+	configs := []map[string]any{{}}
+	for _, key := range s.keys() {
+		values, ok := s.values(key)
+		if !ok {
+			panic(fmt.Sprintf("grid search needs a list of values for '%s', got a range", key))
+		}
+
+		var expanded []map[string]any
+		for _, config := range configs {
+			for _, value := range values {
+				params := make(map[string]any)
+				for k, v := range config {
+					params[k] = v
+				}
+				params[key] = value
+				expanded = append(expanded, params)
+			}
+		}
+		configs = expanded
+	}
+
+	return configs
+}
+
+func (s SweepSpec) random() []map[string]any {
+	rnd := rand.New(rand.NewPCG(s.Seed, 0))
+	configs := make([]map[string]any, max(1, s.Runs))
+	for i := range configs {
+		configs[i] = make(map[string]any)
+		for _, key := range s.keys() {
+			if values, ok := s.values(key); ok {
+				configs[i][key] = values[rnd.IntN(len(values))]
+				continue
+			}
+
+			configs[i][key] = s.sample(key, rnd)
+		}
+	}
+
+	return configs
+}
+
+// Returns the list of values of the key, false if the key has a range instead.
+func (s SweepSpec) values(key string) ([]any, bool) {
+	var values []any
+	if err := json.Unmarshal(s.Params[key], &values); err != nil {
+		return nil, false
+	}
+	if len(values) == 0 {
+		panic(fmt.Sprintf("no values to sweep for '%s'", key))
+	}
+
+	return values, true
+}
+
+func (s SweepSpec) sample(key string, rnd *rand.Rand) any {
+	var r sweepRange
+	decoder := json.NewDecoder(bytes.NewReader(s.Params[key]))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&r); err != nil || r.Min > r.Max || (r.Log && r.Min <= 0) {
+		panic(fmt.Sprintf("'%s' must be a list of values or a range {min, max, log}, got %s", key, s.Params[key]))
+	}
+
+	v := r.Min + rnd.Float64()*(r.Max-r.Min)
+	if r.Log {
+		v = math.Exp(math.Log(r.Min) + rnd.Float64()*(math.Log(r.Max)-math.Log(r.Min)))
+	}
+	if r.Min == math.Trunc(r.Min) && r.Max == math.Trunc(r.Max) {
+		return math.Round(v)
+	}
+
+	return v
+}
+
+// Returns the swept keys in a stable order.
+func (s SweepSpec) keys() []string {
+	var keys []string
+	for key := range s.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Returns config with the fields overridden by params, keys are the JSON names of the fields.
+func applyParams(config Config, params map[string]any) Config {
+	content, err := json.Marshal(config)
+	if err != nil {
+		panic(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(content, &fields); err != nil {
+		panic(err)
+	}
+
+	for key, value := range params {
+		if _, ok := fields[key]; !ok {
+			panic(fmt.Sprintf("unknown config field '%s'", key))
+		}
+		fields[key] = value
+	}
+
+	content, err = json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	var overridden Config
+	if err := json.Unmarshal(content, &overridden); err != nil {
+		panic(fmt.Sprintf("invalid config values %v: %v", params, err))
+	}
+
+	return overridden
+}
+
+func saveConfig(config Config, filename string) {
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filename, append(content, '\n'), 0o644); err != nil {
+		panic(err)
+	}
+}
+
+// Trains a model in a child process, so the runs don't share the global state
+// and a crashed run doesn't take the whole sweep down.
+func train(exe, dir string) error {
+	log, err := os.Create(filepath.Join(dir, "train.log"))
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	cmd := exec.Command(exe, "-config", "config.json", "-metrics-jsonl", "metrics.jsonl", "-no-chat")
+	cmd.Dir = dir
+	cmd.Stdout = log
+	cmd.Stderr = log
+
+	return cmd.Run()
+}
+
+// Returns the lowest validation loss written by the JSONL sink and its step, NaN if there's none.
+func bestValLoss(filename string) (float64, int) {
+	best, bestStep := math.NaN(), 0
+	file, err := os.Open(filename)
+	if err != nil {
+		return best, bestStep
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record struct {
+			Step    int      `json:"step"`
+			ValLoss *float64 `json:"val_loss"` // null if not evaluated
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.ValLoss == nil {
+			continue
+		}
+		if math.IsNaN(best) || *record.ValLoss < best {
+			best, bestStep = *record.ValLoss, record.Step
+		}
+	}
+
+	return best, bestStep
+}
+
+// Sorts the runs by validation loss, failed runs go last, then writes and prints them.
+func writeLeaderboard(runs []*sweepRun, keys []string, filename string) {
+	slices.SortStableFunc(runs, func(a, b *sweepRun) int {
+		switch {
+		case math.IsNaN(a.valLoss) && math.IsNaN(b.valLoss):
+			return 0
+		case math.IsNaN(a.valLoss):
+			return 1
+		case math.IsNaN(b.valLoss):
+			return -1
+		}
+
+		return cmp.Compare(a.valLoss, b.valLoss)
+	})
+
+	file := createFile(filename)
+	defer file.Close()
+	w := csv.NewWriter(file)
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := append([]string{"rank", "run", "val_loss", "best_step"}, keys...)
+	records := [][]string{header}
+	for i, run := range runs {
+		record := []string{strconv.Itoa(i + 1), run.name, formatLoss(run.valLoss), strconv.Itoa(run.bestStep)}
+		for _, key := range keys {
+			record = append(record, fmt.Sprint(run.params[key]))
+		}
+		records = append(records, record)
+	}
+
+	fmt.Printf("\nLeaderboard, saved to %s:\n", filename)
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			panic(err)
+		}
+		for _, cell := range record {
+			fmt.Fprintf(table, "%s\t", cell)
+		}
+		fmt.Fprintln(table)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+	table.Flush()
+}
+
+func formatLoss(loss float64) string {
+	if math.IsNaN(loss) {
+		return ""
+	}
+
+	return strconv.FormatFloat(loss, 'f', 4, 64)
+}